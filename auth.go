@@ -0,0 +1,177 @@
+package sendmail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/smtp"
+	"strings"
+)
+
+// SMTP AUTH mechanisms supported for smart hosts
+const (
+	AuthPlain   = "PLAIN"
+	AuthLogin   = "LOGIN"
+	AuthCRAMMD5 = "CRAM-MD5"
+	AuthXOAuth2 = "XOAUTH2"
+)
+
+// Credentials for smart host authentication
+type Credentials struct {
+	Login    string
+	Password string
+	// Mechanism forces the AUTH mechanism,
+	// negotiated from the server AUTH list if empty
+	Mechanism string
+	// Token is the XOAUTH2 bearer token
+	Token string
+	// TokenFile with the XOAUTH2 bearer token, read on every
+	// authentication so it can be refreshed, overrides Token
+	TokenFile string
+}
+
+// empty reports whether there is nothing to authenticate with,
+// a login or password alone is not used unless the mechanism is forced
+func (c *Credentials) empty() bool {
+	return (c.Login == "" || c.Password == "") && c.Token == "" && c.TokenFile == "" && c.Mechanism == ""
+}
+
+// mechanism return forced mechanism or the preferred one
+// offered by the server which the credentials are suitable for.
+func (c *Credentials) mechanism(offered string) (string, error) {
+	if c.Mechanism != "" {
+		return strings.ToUpper(c.Mechanism), nil
+	}
+	available := make(map[string]bool)
+	for _, mech := range strings.Fields(strings.ToUpper(offered)) {
+		available[mech] = true
+	}
+	var preferred []string
+	if c.Token != "" || c.TokenFile != "" {
+		preferred = append(preferred, AuthXOAuth2)
+	}
+	if c.Password != "" {
+		preferred = append(preferred, AuthCRAMMD5, AuthPlain, AuthLogin)
+	}
+	for _, mech := range preferred {
+		if available[mech] {
+			return mech, nil
+		}
+	}
+	return "", fmt.Errorf("no supported AUTH mechanism in %q", offered)
+}
+
+// auth return authentication by mechanism for server host
+func (c *Credentials) auth(mechanism, host string) (smtp.Auth, error) {
+	switch mechanism {
+	case AuthPlain:
+		return smtp.PlainAuth("", c.Login, c.Password, host), nil
+	case AuthLogin:
+		return &loginAuth{c.Login, c.Password, host}, nil
+	case AuthCRAMMD5:
+		return smtp.CRAMMD5Auth(c.Login, c.Password), nil
+	case AuthXOAuth2:
+		return &xoauth2Auth{c, host}, nil
+	}
+	return nil, fmt.Errorf("unsupported AUTH mechanism %s", mechanism)
+}
+
+// authenticate the client with the mechanism negotiated from
+// the EHLO AUTH list and return the used mechanism.
+func (c *Credentials) authenticate(client *smtp.Client, host string) (string, error) {
+	ok, offered := client.Extension("AUTH")
+	if !ok && c.Mechanism == "" {
+		return "", errors.New("smtp: server doesn't support AUTH")
+	}
+	mechanism, err := c.mechanism(offered)
+	if err != nil {
+		return "", err
+	}
+	auth, err := c.auth(mechanism, host)
+	if err != nil {
+		return "", err
+	}
+	return mechanism, client.Auth(auth)
+}
+
+// token return the XOAUTH2 bearer token
+func (c *Credentials) token() (string, error) {
+	if c.TokenFile == "" {
+		return c.Token, nil
+	}
+	data, err := ioutil.ReadFile(c.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(data)), nil
+}
+
+// errInsecureAuth is returned when credentials would be sent in clear text
+var errInsecureAuth = errors.New("unencrypted connection")
+
+// isLocalhost reports whether credentials may be sent to host without TLS
+func isLocalhost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+// loginAuth implements the LOGIN mechanism
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errInsecureAuth
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return AuthLogin, nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	prompt := strings.ToLower(string(fromServer))
+	switch {
+	case strings.HasPrefix(prompt, "user"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "pass"):
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+}
+
+// xoauth2Auth implements the XOAUTH2 mechanism
+type xoauth2Auth struct {
+	credentials *Credentials
+	host        string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errInsecureAuth
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	token, err := a.credentials.token()
+	if err != nil {
+		return "", nil, err
+	}
+	if token == "" {
+		return "", nil, errors.New("empty XOAUTH2 token")
+	}
+	return AuthXOAuth2, []byte("user=" + a.credentials.Login + "\x01auth=Bearer " + token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// The challenge is a JSON error, an empty response
+		// makes the server send the final reply
+		return []byte{}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,69 @@
+package sendmail_test
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/test"
+)
+
+func TestSendSmarthostAuth(t *testing.T) {
+	go test.StartSMTPS()
+	test.WaitPort(test.PortSMTPS)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte(test.AuthToken+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		credentials sendmail.Credentials
+		mechanism   string
+	}{
+		{sendmail.Credentials{Login: test.AuthUser, Password: test.AuthPassword}, sendmail.AuthCRAMMD5},
+		{sendmail.Credentials{Login: test.AuthUser, Password: test.AuthPassword, Mechanism: "login"}, sendmail.AuthLogin},
+		{sendmail.Credentials{Login: test.AuthUser, Password: test.AuthPassword, Mechanism: sendmail.AuthPlain}, sendmail.AuthPlain},
+		{sendmail.Credentials{Login: test.AuthUser, Token: test.AuthToken}, sendmail.AuthXOAuth2},
+		{sendmail.Credentials{Login: test.AuthUser, Token: "expired", TokenFile: tokenFile}, sendmail.AuthXOAuth2},
+		{sendmail.Credentials{Login: test.AuthUser, Password: "wrong"}, ""},
+		{sendmail.Credentials{Login: test.AuthUser, Password: "wrong", Mechanism: sendmail.AuthLogin}, ""},
+		{sendmail.Credentials{Login: test.AuthUser, Token: "expired"}, ""},
+	}
+	for _, tt := range tests {
+		envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelope.TLSConfig = &tls.Config{RootCAs: test.CertPool()}
+		delivered := false
+		for result := range envelope.SendSmarthostAuth("smtps://localhost:"+test.PortSMTPS, tt.credentials) {
+			if result.Level == sendmail.InfoLevel {
+				delivered = true
+				if result.Fields["auth"] != tt.mechanism {
+					t.Error("Expected mechanism", tt.mechanism, "got", result.Fields["auth"])
+				}
+			}
+		}
+		if delivered != (tt.mechanism != "") {
+			t.Error(tt.credentials, "expected delivered", tt.mechanism != "", "got", delivered)
+		}
+	}
+
+	// A login alone is not used for AUTH, as SENDMAIL_SMART_LOGIN without password
+	envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.TLSConfig = &tls.Config{RootCAs: test.CertPool()}
+	for result := range envelope.SendSmarthostAuth("smtps://localhost:"+test.PortSMTPS, sendmail.Credentials{Login: test.AuthUser}) {
+		if result.Level < sendmail.WarnLevel {
+			t.Error(result.Error)
+		}
+		if auth, ok := result.Fields["auth"]; ok {
+			t.Error("Expected no AUTH with login alone, got", auth)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package sendmail
+
+import (
+	"crypto/tls"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// DialTimeout for connections to mail servers
+var DialTimeout = 30 * time.Second
+
+// connect to the server at addr without STARTTLS negotiation,
+// TLS is established right away if tlsConfig is not nil.
+func connect(addr, host string, tlsConfig *tls.Config) (*smtp.Client, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: DialTimeout}, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, DialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// smtpServer describes connection to a mail server
+type smtpServer struct {
+	// addr to dial, host:port
+	addr string
+	// name of the server used for TLS verification
+	name string
+	// policy of STARTTLS negotiation
+	policy TLSPolicy
+	// implicitTLS establish TLS on connect instead of STARTTLS (SMTPS)
+	implicitTLS bool
+	// tlsConfig overrides the default certificate verification (optional)
+	tlsConfig *tls.Config
+	// credentials for the smart host (optional)
+	credentials *Credentials
+}
+
+// dial connect to the server and negotiate STARTTLS according
+// to its policy. It returns fields describing the TLS outcome.
+func dial(server smtpServer) (*smtp.Client, Fields, error) {
+	tlsConfig := server.tlsConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: server.name}
+	}
+	if server.implicitTLS {
+		c, err := connect(server.addr, server.name, tlsConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		state, _ := c.TLSConnectionState()
+		return c, tlsFields(&state, true), nil
+	}
+	c, err := connect(server.addr, server.name, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if server.policy == TLSNone {
+		return c, tlsFields(nil, false), nil
+	}
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		if server.policy == TLSRequire {
+			c.Close()
+			return nil, nil, errNoSTARTTLS
+		}
+		return c, tlsFields(nil, false), nil
+	}
+	tlsErr := c.StartTLS(tlsConfig)
+	if tlsErr == nil {
+		state, _ := c.TLSConnectionState()
+		return c, tlsFields(&state, true), nil
+	}
+	c.Close()
+	if server.policy != TLSOpportunistic {
+		return nil, nil, tlsErr
+	}
+	if isCertificateError(tlsErr) {
+		// Encrypt without verification on a new connection
+		c, err = connect(server.addr, server.name, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		insecure := tlsConfig.Clone()
+		insecure.InsecureSkipVerify = true
+		if err := c.StartTLS(insecure); err == nil {
+			state, _ := c.TLSConnectionState()
+			fields := tlsFields(&state, false)
+			fields["tls_error"] = tlsErr.Error()
+			return c, fields, nil
+		}
+		c.Close()
+	}
+	// The handshake failed, fall back to plain text on a new connection
+	c, err = connect(server.addr, server.name, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := tlsFields(nil, false)
+	fields["tls_error"] = tlsErr.Error()
+	return c, fields, nil
+}
+
+// sendTo drives the SMTP dialogue with the server. Unlike
+// smtp.SendMail it continues past rejected recipients and returns the
+// delivery error of every recipient, nil for the delivered ones,
+// and fields describing the TLS outcome.
+func (e *Envelope) sendTo(server smtpServer, addresses []string, body []byte) (map[string]error, Fields) {
+	statuses := make(map[string]error, len(addresses))
+	// fail set the session error for every recipient without status
+	fail := func(err error) map[string]error {
+		for _, address := range addresses {
+			if _, ok := statuses[address]; !ok {
+				statuses[address] = err
+			}
+		}
+		return statuses
+	}
+
+	c, fields, err := dial(server)
+	if err != nil {
+		return fail(err), nil
+	}
+	defer c.Close()
+
+	if server.credentials != nil && !server.credentials.empty() {
+		mechanism, err := server.credentials.authenticate(c, server.name)
+		if err != nil {
+			return fail(err), fields
+		}
+		fields["auth"] = mechanism
+	}
+	if err := c.Mail(e.mailFrom()); err != nil {
+		return fail(err), fields
+	}
+	var accepted []string
+	for _, address := range addresses {
+		if err := c.Rcpt(address); err != nil {
+			statuses[address] = err
+		} else {
+			accepted = append(accepted, address)
+		}
+	}
+	if len(accepted) == 0 {
+		c.Quit()
+		return statuses, fields
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fail(err), fields
+	}
+	if _, err := w.Write(body); err != nil {
+		return fail(err), fields
+	}
+	if err := w.Close(); err != nil {
+		return fail(err), fields
+	}
+	for _, address := range accepted {
+		statuses[address] = nil
+	}
+	c.Quit()
+	return statuses, fields
+}
+
+// recipientResult return result of delivery to one recipient with the SMTP
+// reply code, enhanced status code, server text and TLS outcome added to fields.
+func recipientResult(err error, fields, tlsInfo Fields) Result {
+	for k, v := range tlsInfo {
+		fields[k] = v
+	}
+	if err == nil {
+		fields["code"] = 250
+		return Result{InfoLevel, nil, "Send mail OK", fields}
+	}
+	failed := newFailedRecipient("", "", err)
+	if failed.Code != 0 {
+		fields["code"] = failed.Code
+		fields["enhanced_code"] = failed.Status
+		fields["reply"] = failed.Message
+	}
+	return Result{WarnLevel, err, "", fields}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/n0madic/sendmail"
+)
+
+// arrayNetworks is a list of networks in CIDR notation,
+// a single address is a network of one host
+type arrayNetworks []*net.IPNet
+
+func (n *arrayNetworks) String() string {
+	var list []string
+	for _, network := range *n {
+		list = append(list, network.String())
+	}
+	return strings.Join(list, ",")
+}
+
+func (n *arrayNetworks) Set(value string) error {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return fmt.Errorf("invalid address %s", value)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			bits = 8 * net.IPv4len
+		}
+		value = fmt.Sprintf("%s/%d", value, bits)
+	}
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return err
+	}
+	*n = append(*n, network)
+	return nil
+}
+
+// Contains reports whether ip belongs to any of the networks
+func (n arrayNetworks) Contains(ip net.IP) bool {
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetworks return networks of the list
+func parseNetworks(values []string) (arrayNetworks, error) {
+	var networks arrayNetworks
+	for _, value := range values {
+		if err := networks.Set(value); err != nil {
+			return nil, err
+		}
+	}
+	return networks, nil
+}
+
+// accessList controls which clients may connect and where they may relay
+type accessList struct {
+	// allow clients only from these networks, any if empty
+	allow arrayNetworks
+	// deny clients from these networks, it takes precedence over allow
+	deny arrayNetworks
+	// trusted networks may relay to any domain without authentication
+	trusted arrayNetworks
+	// local domains accepted from any allowed client
+	localDomains arrayDomains
+}
+
+// clientIP return IP address of the remote address, nil for Unix sockets
+func clientIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
+
+// allowed reports whether the client may connect, Unix sockets are always allowed
+func (a *accessList) allowed(ip net.IP) bool {
+	if ip == nil {
+		return true
+	}
+	if a.deny.Contains(ip) {
+		return false
+	}
+	return len(a.allow) == 0 || a.allow.Contains(ip)
+}
+
+// trustedClient reports whether the client is local or in the trusted networks
+func (a *accessList) trustedClient(ip net.IP) bool {
+	return ip == nil || ip.IsLoopback() || a.trusted.Contains(ip)
+}
+
+// relayAllowed reports whether the client may send to the recipient.
+// Relaying is not restricted unless trusted networks or local domains are set.
+func (a *accessList) relayAllowed(ip net.IP, authenticated bool, recipient string) bool {
+	if len(a.trusted) == 0 && len(a.localDomains) == 0 {
+		return true
+	}
+	if authenticated || a.trustedClient(ip) {
+		return true
+	}
+	domain := sendmail.GetDomainFromAddress(recipient)
+	for _, local := range a.localDomains {
+		if strings.EqualFold(local, domain) {
+			return true
+		}
+	}
+	return false
+}
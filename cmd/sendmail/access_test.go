@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func mustNetworks(t *testing.T, values ...string) arrayNetworks {
+	t.Helper()
+	networks, err := parseNetworks(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return networks
+}
+
+func TestArrayNetworksSet(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+		valid    bool
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", true},
+		{"10.1.2.3/8", "10.0.0.0/8", true},
+		{"192.168.1.1", "192.168.1.1/32", true},
+		{"::1", "::1/128", true},
+		{"2001:db8::/32", "2001:db8::/32", true},
+		{"example.com", "", false},
+		{"10.0.0.0/33", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		var networks arrayNetworks
+		err := networks.Set(tt.value)
+		if (err == nil) != tt.valid {
+			t.Errorf("%q: expected valid %v, got error %v", tt.value, tt.valid, err)
+			continue
+		}
+		if tt.valid && networks.String() != tt.expected {
+			t.Errorf("%q: expected %s, got %s", tt.value, tt.expected, networks.String())
+		}
+	}
+}
+
+func TestAccessListAllowed(t *testing.T) {
+	access := &accessList{
+		allow: mustNetworks(t, "10.0.0.0/8", "192.168.0.0/16"),
+		deny:  mustNetworks(t, "10.13.0.0/16", "192.168.1.1"),
+	}
+	open := &accessList{deny: mustNetworks(t, "10.13.0.0/16")}
+	tests := []struct {
+		access   *accessList
+		addr     string
+		expected bool
+	}{
+		{access, "10.1.2.3:2525", true},
+		{access, "192.168.2.1:2525", true},
+		// Deny takes precedence over allow
+		{access, "10.13.0.1:2525", false},
+		{access, "192.168.1.1:2525", false},
+		{access, "172.16.0.1:2525", false},
+		{access, "[2001:db8::1]:2525", false},
+		// Unix sockets are always allowed
+		{access, "@", true},
+		{access, "/run/sendmail.sock", true},
+		{open, "172.16.0.1:2525", true},
+		{open, "10.13.0.1:2525", false},
+	}
+	for _, tt := range tests {
+		if allowed := tt.access.allowed(clientIP(tt.addr)); allowed != tt.expected {
+			t.Errorf("%s: expected allowed %v, got %v", tt.addr, tt.expected, allowed)
+		}
+	}
+}
+
+func TestAccessListRelayAllowed(t *testing.T) {
+	restricted := &accessList{
+		trusted:      mustNetworks(t, "10.1.0.0/24"),
+		localDomains: arrayDomains{"example.com"},
+	}
+	tests := []struct {
+		access        *accessList
+		ip            net.IP
+		authenticated bool
+		recipient     string
+		expected      bool
+	}{
+		// Not restricted without trusted networks and local domains
+		{&accessList{}, net.ParseIP("203.0.113.1"), false, "user@example.org", true},
+		{restricted, net.ParseIP("203.0.113.1"), false, "user@example.org", false},
+		{restricted, net.ParseIP("203.0.113.1"), false, "user@EXAMPLE.com", true},
+		{restricted, net.ParseIP("203.0.113.1"), false, "user@sub.example.com", false},
+		{restricted, net.ParseIP("203.0.113.1"), true, "user@example.org", true},
+		{restricted, net.ParseIP("10.1.0.7"), false, "user@example.org", true},
+		{restricted, net.ParseIP("10.2.0.7"), false, "user@example.org", false},
+		{restricted, net.ParseIP("127.0.0.1"), false, "user@example.org", true},
+		{restricted, net.ParseIP("::1"), false, "user@example.org", true},
+		// Unix socket
+		{restricted, nil, false, "user@example.org", true},
+	}
+	for _, tt := range tests {
+		if allowed := tt.access.relayAllowed(tt.ip, tt.authenticated, tt.recipient); allowed != tt.expected {
+			t.Errorf("%v authenticated %v to %s: expected %v, got %v",
+				tt.ip, tt.authenticated, tt.recipient, tt.expected, allowed)
+		}
+	}
+}
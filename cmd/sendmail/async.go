@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/n0madic/sendmail"
+	log "github.com/sirupsen/logrus"
+)
+
+// deliveries are queue IDs waiting for a worker, messages which do not fit
+// are left in the queue for the queue runner
+var deliveries = make(chan string, 1000)
+
+// accept write message to the queue and pass it to the workers,
+// it returns the queue ID of the message
+func accept(envelope *sendmail.Envelope) (string, error) {
+	id, err := queue.Accept(envelope)
+	if err != nil {
+		return "", err
+	}
+	log.WithFields(getLogFields(sendmail.Fields{
+		"sender":     envelope.Header.Get("From"),
+		"recipients": envelope.Recipients,
+		"queue_id":   id,
+	})).Info("Accepted for delivery")
+	if !isStopping() {
+		select {
+		case deliveries <- id:
+		default:
+		}
+	}
+	return id, nil
+}
+
+// startWorkers deliver accepted messages until stop is closed,
+// the returned channel is closed when the workers are finished
+func startWorkers(workers int, stop <-chan struct{}) <-chan struct{} {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				case id := <-deliveries:
+					deliver(id)
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// deliver accepted message, the queue keeps it until every
+// recipient got a final status
+func deliver(id string) {
+	for result := range queue.Deliver(id) {
+		logResult(result)
+	}
+}
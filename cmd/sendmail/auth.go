@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/n0madic/sendmail"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator checks credentials of SMTP clients
+type Authenticator interface {
+	// Authenticate return nil if the password of username is valid
+	Authenticate(username, password string) error
+	// AllowedSender reports whether the user may send from the address
+	AllowedSender(username, address string) bool
+}
+
+// userDB authenticates users by bcrypt hashes, as in htpasswd -B files
+type userDB struct {
+	hashes map[string][]byte
+	// senders allowed per user, any if the user has no entries
+	senders map[string][]string
+}
+
+// newUserDB return database of users with hashes and allowed senders
+func newUserDB(hashes map[string]string, senders map[string][]string) (*userDB, error) {
+	db := &userDB{
+		hashes:  make(map[string][]byte),
+		senders: senders,
+	}
+	for user, hash := range hashes {
+		if err := db.add(user, hash); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+func (db *userDB) add(user, hash string) error {
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return fmt.Errorf("user %s: password is not a bcrypt hash", user)
+	}
+	db.hashes[user] = []byte(hash)
+	return nil
+}
+
+// loadHtpasswd add users of htpasswd file with "user:hash" lines
+func (db *userDB) loadHtpasswd(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%s line %d: expected user:hash", path, line)
+		}
+		if err := db.add(parts[0], parts[1]); err != nil {
+			return fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Authenticate check password of username
+func (db *userDB) Authenticate(username, password string) error {
+	hash, ok := db.hashes[username]
+	if !ok {
+		// Spend the same time as for existing users
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return errInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return errInvalidCredentials
+	}
+	return nil
+}
+
+// AllowedSender reports whether address matches an entry of the user,
+// an entry is an address, a domain or a "*.domain" wildcard.
+func (db *userDB) AllowedSender(username, address string) bool {
+	patterns := db.senders[username]
+	if len(patterns) == 0 {
+		return true
+	}
+	address = strings.ToLower(address)
+	domain := sendmail.GetDomainFromAddress(address)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimPrefix(pattern, "@"))
+		switch {
+		case strings.Contains(pattern, "@"):
+			if address == pattern {
+				return true
+			}
+		case strings.HasPrefix(pattern, "*."):
+			if strings.HasSuffix(domain, pattern[1:]) {
+				return true
+			}
+		case domain == pattern:
+			return true
+		}
+	}
+	return false
+}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+// isLocalListener reports whether the address is a Unix socket or a loopback one
+func isLocalListener(bindAddr string) bool {
+	if strings.Contains(bindAddr, "/") {
+		return true
+	}
+	host, _, err := net.SplitHostPort(bindAddr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
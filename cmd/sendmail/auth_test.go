@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func TestLoadHtpasswd(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{"bcrypt", "# users\n\napp:" + testHash(t, "secret") + "\n", true},
+		{"plaintext", "app:secret\n", false},
+		{"md5", "app:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n", false},
+		{"sha1", "app:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n", false},
+		{"no hash", "app\n", false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "htpasswd")
+		if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		db, err := newUserDB(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.loadHtpasswd(path)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid %v, got error %v", tt.name, tt.valid, err)
+		}
+	}
+
+	if _, err := newUserDB(map[string]string{"app": "secret"}, nil); err == nil {
+		t.Error("Expected error for plaintext password in configuration")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	db, err := newUserDB(map[string]string{"app": testHash(t, "secret")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		username string
+		password string
+		valid    bool
+	}{
+		{"app", "secret", true},
+		{"app", "wrong", false},
+		{"app", "", false},
+		{"other", "secret", false},
+		{"APP", "secret", false},
+	}
+	for _, tt := range tests {
+		if err := db.Authenticate(tt.username, tt.password); (err == nil) != tt.valid {
+			t.Errorf("%s:%s: expected valid %v, got error %v", tt.username, tt.password, tt.valid, err)
+		}
+	}
+}
+
+func TestAllowedSender(t *testing.T) {
+	db, err := newUserDB(nil, map[string][]string{
+		"app":    {"noreply@example.com", "example.org", "*.example.net"},
+		"legacy": {"@example.info"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		username string
+		address  string
+		expected bool
+	}{
+		{"app", "noreply@example.com", true},
+		{"app", "NoReply@Example.com", true},
+		{"app", "other@example.com", false},
+		{"app", "anyone@example.org", true},
+		{"app", "anyone@sub.example.org", false},
+		{"app", "anyone@mail.example.net", true},
+		{"app", "anyone@a.b.example.net", true},
+		// The wildcard is for subdomains only
+		{"app", "anyone@example.net", false},
+		// Not a subdomain, only the same suffix
+		{"app", "anyone@badexample.net", false},
+		{"app", "anyone@example.net.evil.test", false},
+		{"legacy", "anyone@example.info", true},
+		// Users without entries may use any sender
+		{"nobody", "anyone@example.test", true},
+	}
+	for _, tt := range tests {
+		if allowed := db.AllowedSender(tt.username, tt.address); allowed != tt.expected {
+			t.Errorf("%s as %s: expected %v, got %v", tt.username, tt.address, tt.expected, allowed)
+		}
+	}
+}
+
+func TestIsLocalListener(t *testing.T) {
+	tests := map[string]bool{
+		"localhost:25":        true,
+		"127.0.0.1:25":        true,
+		"[::1]:25":            true,
+		"/run/sendmail.sock":  true,
+		":25":                 false,
+		"0.0.0.0:25":          false,
+		"mail.example.com:25": false,
+	}
+	for addr, expected := range tests {
+		if local := isLocalListener(addr); local != expected {
+			t.Errorf("%s: expected local %v, got %v", addr, expected, local)
+		}
+	}
+}
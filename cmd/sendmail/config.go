@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultConfigFile is loaded if it exists and -config is not set
+const DefaultConfigFile = "/etc/sendmail.yaml"
+
+// fileConfig is the layout of the configuration file
+type fileConfig struct {
+	Log struct {
+		Verbose *bool  `yaml:"verbose"`
+		Format  string `yaml:"format"`
+	} `yaml:"log"`
+	HTTP struct {
+		Enabled *bool  `yaml:"enabled"`
+		Bind    string `yaml:"bind"`
+		Token   string `yaml:"token"`
+	} `yaml:"http"`
+	SMTP struct {
+		Enabled         *bool  `yaml:"enabled"`
+		Bind            string `yaml:"bind"`
+		ReadTimeout     string `yaml:"read_timeout"`
+		WriteTimeout    string `yaml:"write_timeout"`
+		MaxMessageBytes int    `yaml:"max_message_bytes"`
+		MaxRecipients   int    `yaml:"max_recipients"`
+		// Acknowledge DATA once spooled, deliver by workers
+		Async   *bool `yaml:"async"`
+		Workers int   `yaml:"workers"`
+		// Implicit TLS listener
+		SMTPSBind string `yaml:"smtps_bind"`
+		TLSCert   string `yaml:"tls_cert"`
+		TLSKey    string `yaml:"tls_key"`
+	} `yaml:"smtp"`
+	SenderDomains []string `yaml:"sender_domains"`
+	Auth          struct {
+		// File in htpasswd format with bcrypt hashes
+		File     string `yaml:"file"`
+		Required *bool  `yaml:"required"`
+		Insecure *bool  `yaml:"allow_insecure"`
+		TLS      *bool  `yaml:"require_tls"`
+		// Users and their bcrypt password hashes
+		Users map[string]string `yaml:"users"`
+		// Senders allowed per user: addresses, domains or *.domain
+		Senders map[string][]string `yaml:"senders"`
+	} `yaml:"auth"`
+	Access struct {
+		Allow        []string `yaml:"allow"`
+		Deny         []string `yaml:"deny"`
+		Trusted      []string `yaml:"trusted"`
+		LocalDomains []string `yaml:"local_domains"`
+	} `yaml:"access"`
+	DKIM struct {
+		// Signed header fields, the library default if empty
+		Headers []string        `yaml:"headers"`
+		Keys    []dkimKeyConfig `yaml:"keys"`
+	} `yaml:"dkim"`
+	SmartHosts []struct {
+		URL       string `yaml:"url"`
+		Priority  int    `yaml:"priority"`
+		Weight    int    `yaml:"weight"`
+		Login     string `yaml:"login"`
+		Password  string `yaml:"password"`
+		Auth      string `yaml:"auth"`
+		Token     string `yaml:"token"`
+		TokenFile string `yaml:"token_file"`
+	} `yaml:"smart_hosts"`
+	TLS struct {
+		Policy string `yaml:"policy"`
+		MTASTS *bool  `yaml:"mta_sts"`
+		DANE   *bool  `yaml:"dane"`
+	} `yaml:"tls"`
+	DNS struct {
+		Server     string `yaml:"server"`
+		CacheStats string `yaml:"cache_stats"`
+	} `yaml:"dns"`
+	Queue struct {
+		Dir      string `yaml:"dir"`
+		Interval string `yaml:"interval"`
+		Lifetime string `yaml:"lifetime"`
+	} `yaml:"queue"`
+	Bounce          *bool  `yaml:"bounce"`
+	ShutdownTimeout string `yaml:"shutdown_timeout"`
+	TransportMap    string `yaml:"transport_map"`
+	LocalDir        string `yaml:"local_dir"`
+}
+
+// loadConfig read configuration file, unknown keys are an error
+// as a misspelled restriction would be silently ignored otherwise
+func loadConfig(path string) (*fileConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config := &fileConfig{}
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+// flags return file values of command line flags by flag name
+func (c *fileConfig) flags() map[string][]string {
+	values := make(map[string][]string)
+	set := func(name, value string) {
+		if value != "" {
+			values[name] = append(values[name], value)
+		}
+	}
+	setBool := func(name string, value *bool) {
+		if value != nil {
+			set(name, strconv.FormatBool(*value))
+		}
+	}
+	setBool("v", c.Log.Verbose)
+	set("logFormat", c.Log.Format)
+	setBool("http", c.HTTP.Enabled)
+	set("httpBind", c.HTTP.Bind)
+	set("httpToken", c.HTTP.Token)
+	setBool("smtp", c.SMTP.Enabled)
+	set("smtpBind", c.SMTP.Bind)
+	setBool("smtpAsync", c.SMTP.Async)
+	set("smtpsBind", c.SMTP.SMTPSBind)
+	set("smtpTLSCert", c.SMTP.TLSCert)
+	set("smtpTLSKey", c.SMTP.TLSKey)
+	setBool("authRequired", c.Auth.Required)
+	setBool("allowInsecureAuth", c.Auth.Insecure)
+	setBool("authRequireTLS", c.Auth.TLS)
+	set("tlsPolicy", c.TLS.Policy)
+	setBool("mtaSts", c.TLS.MTASTS)
+	setBool("dane", c.TLS.DANE)
+	set("dnsServer", c.DNS.Server)
+	set("dnsCacheStats", c.DNS.CacheStats)
+	set("queueDir", c.Queue.Dir)
+	set("queueInterval", c.Queue.Interval)
+	set("queueLifetime", c.Queue.Lifetime)
+	setBool("bounce", c.Bounce)
+	set("shutdownTimeout", c.ShutdownTimeout)
+	return values
+}
+
+// apply file values to the flags not set on the command line,
+// the reloadable settings are applied by newSettings
+func (c *fileConfig) apply(flags *flag.FlagSet) error {
+	for name, values := range c.flags() {
+		if explicitFlags[name] {
+			continue
+		}
+		for _, value := range values {
+			if err := flags.Set(name, value); err != nil {
+				return fmt.Errorf("invalid %s value %q: %v", name, value, err)
+			}
+		}
+	}
+
+	if c.SMTP.ReadTimeout != "" {
+		timeout, err := time.ParseDuration(c.SMTP.ReadTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid smtp read_timeout: %v", err)
+		}
+		smtpReadTimeout = timeout
+	}
+	if c.SMTP.WriteTimeout != "" {
+		timeout, err := time.ParseDuration(c.SMTP.WriteTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid smtp write_timeout: %v", err)
+		}
+		smtpWriteTimeout = timeout
+	}
+	if c.SMTP.MaxMessageBytes > 0 {
+		smtpMaxMessageBytes = c.SMTP.MaxMessageBytes
+	}
+	if c.SMTP.MaxRecipients > 0 {
+		smtpMaxRecipients = c.SMTP.MaxRecipients
+	}
+	if c.SMTP.Workers > 0 {
+		smtpWorkers = c.SMTP.Workers
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sendmail.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, `
+smtp:
+  bind: ":2525"
+  max_recipients: 10
+sender_domains:
+  - example.com
+  - example.org
+bounce: true
+smart_hosts:
+  - url: smtps://relay.example.com
+    priority: 10
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.SMTP.Bind != ":2525" || config.SMTP.MaxRecipients != 10 {
+		t.Error("Unexpected smtp section", config.SMTP)
+	}
+	if strings.Join(config.SenderDomains, ",") != "example.com,example.org" {
+		t.Error("Unexpected sender domains", config.SenderDomains)
+	}
+	if config.Bounce == nil || !*config.Bounce {
+		t.Error("Expected bounce enabled")
+	}
+	if len(config.SmartHosts) != 1 || config.SmartHosts[0].Priority != 10 {
+		t.Error("Unexpected smart hosts", config.SmartHosts)
+	}
+
+	if _, err := loadConfig(writeConfig(t, "")); err != nil {
+		t.Error("Expected empty file to be valid, got", err)
+	}
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	for _, content := range []string{
+		"sender_domain:\n  - example.com\n",
+		"smtp:\n  bnd: \":2525\"\n",
+		"auth:\n  require: true\n",
+	} {
+		if _, err := loadConfig(writeConfig(t, content)); err == nil {
+			t.Errorf("Expected error for unknown key in %q", content)
+		}
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	var (
+		bind     string
+		bounced  bool
+		queueDir string
+	)
+	flags := flag.NewFlagSet("sendmail", flag.ContinueOnError)
+	flags.StringVar(&bind, "smtpBind", "localhost:25", "")
+	flags.BoolVar(&bounced, "bounce", false, "")
+	flags.StringVar(&queueDir, "queueDir", "", "")
+	if err := flags.Parse([]string{"-smtpBind", "localhost:2525"}); err != nil {
+		t.Fatal(err)
+	}
+	explicitFlags["smtpBind"] = true
+	defer delete(explicitFlags, "smtpBind")
+	defer func(recipients int) { smtpMaxRecipients = recipients }(smtpMaxRecipients)
+
+	config, err := loadConfig(writeConfig(t, `
+smtp:
+  bind: ":2525"
+  max_recipients: 10
+queue:
+  dir: /var/spool/sendmail
+bounce: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.apply(flags); err != nil {
+		t.Fatal(err)
+	}
+	// The command line takes precedence over the file
+	if bind != "localhost:2525" {
+		t.Error("Expected smtpBind of the command line, got", bind)
+	}
+	if !bounced || queueDir != "/var/spool/sendmail" {
+		t.Error("Expected file values of flags not set, got", bounced, queueDir)
+	}
+	if smtpMaxRecipients != 10 {
+		t.Error("Expected max_recipients 10, got", smtpMaxRecipients)
+	}
+}
+
+func TestNewSettingsSenderDomains(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, "sender_domains:\n  - file.example\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSettings(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(s.senderDomains, ",") != "file.example" {
+		t.Error("Expected sender domains of the file, got", s.senderDomains)
+	}
+
+	defer func(domains arrayDomains) { senderDomains = domains }(senderDomains)
+	senderDomains = arrayDomains{"flag.example"}
+	explicitFlags["senderDomain"] = true
+	defer delete(explicitFlags, "senderDomain")
+	s, err = newSettings(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(s.senderDomains, ",") != "flag.example" {
+		t.Error("Expected sender domains of the command line, got", s.senderDomains)
+	}
+}
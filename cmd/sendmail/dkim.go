@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/n0madic/sendmail"
+)
+
+// dkimKeyConfig is a signing key of a sender domain
+type dkimKeyConfig struct {
+	Domain   string `yaml:"domain"`
+	Selector string `yaml:"selector"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// parseDKIMKey parse -dkimKey value in domain:selector:keyfile format
+func parseDKIMKey(value string) (dkimKeyConfig, error) {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return dkimKeyConfig{}, fmt.Errorf("invalid DKIM key %q, expected domain:selector:keyfile", value)
+	}
+	return dkimKeyConfig{Domain: parts[0], Selector: parts[1], KeyFile: parts[2]}, nil
+}
+
+// newDKIM return signer of the configured domains, nil if there are no keys
+func newDKIM(keys []dkimKeyConfig, headers []string) (*sendmail.DKIM, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	dkim := &sendmail.DKIM{
+		Keys:    make(map[string]*sendmail.DKIMKey),
+		Headers: headers,
+	}
+	for _, key := range keys {
+		if key.Domain == "" || key.Selector == "" || key.KeyFile == "" {
+			return nil, fmt.Errorf("DKIM key requires domain, selector and key_file")
+		}
+		signer, err := sendmail.LoadDKIMKey(key.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		dkim.Keys[strings.ToLower(key.Domain)] = &sendmail.DKIMKey{
+			Selector: key.Selector,
+			Signer:   signer,
+		}
+	}
+	return dkim, nil
+}
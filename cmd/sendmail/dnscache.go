@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/n0madic/sendmail"
+	log "github.com/sirupsen/logrus"
+)
+
+// logDNSCacheStats periodically log hit rate of the DNS cache
+func logDNSCacheStats(cache *sendmail.CachingResolver, interval time.Duration) {
+	for range time.Tick(interval) {
+		stats := cache.Stats()
+		log.WithFields(log.Fields{
+			"hits":     stats.Hits,
+			"misses":   stats.Misses,
+			"entries":  stats.Entries,
+			"hit_rate": fmt.Sprintf("%.1f%%", stats.HitRate()*100),
+		}).Info("DNS cache statistics")
+	}
+}
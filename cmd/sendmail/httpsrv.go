@@ -12,6 +12,14 @@ import (
 
 func handler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
+		ip := clientIP(r.RemoteAddr)
+		access := current().access
+		if !access.allowed(ip) {
+			w.WriteHeader(http.StatusForbidden)
+			log.Errorf("Connection from denied address %s", ip)
+			fmt.Fprint(w, "Forbidden")
+			return
+		}
 		if httpToken != "" && r.Header.Get("Token") != httpToken {
 			w.WriteHeader(http.StatusUnauthorized)
 			log.Errorf("Attempt to unauthorized send with token %s", r.Header.Get("Token"))
@@ -37,26 +45,37 @@ func handler(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprint(w, err)
 		} else {
+			configureEnvelope(&envelope)
+			for _, recipient := range envelope.Recipients {
+				if !access.relayAllowed(ip, httpToken != "", recipient) {
+					w.WriteHeader(http.StatusForbidden)
+					log.Errorf("Relay access denied for %s to %s", ip, recipient)
+					fmt.Fprint(w, "Relay access denied for ", recipient)
+					return
+				}
+			}
 			senderDomain := sendmail.GetDomainFromAddress(envelope.Header["From"][0])
-			if len(senderDomains) > 0 && !senderDomains.Contains(senderDomain) {
+			if domains := current().senderDomains; len(domains) > 0 && !domains.Contains(senderDomain) {
 				w.WriteHeader(http.StatusUnauthorized)
 				log.Errorf("Attempt to unauthorized send with domain %s", senderDomain)
 				fmt.Fprint(w, "Unauthorized sender domain")
 				return
 			}
-			errs := envelope.Send()
-			for result := range errs {
-				switch {
-				case result.Level > sendmail.WarnLevel:
-					log.WithFields(getLogFields(result.Fields)).Info(result.Message)
+			if spooled, err := spool(&envelope, body); spooled {
+				if err != nil {
+					log.Error(err)
+					w.WriteHeader(http.StatusServiceUnavailable)
+					fmt.Fprint(w, err)
+				} else {
 					fmt.Fprint(w, "Send mail OK")
-				case result.Level == sendmail.WarnLevel:
-					log.WithFields(getLogFields(result.Fields)).Warn(result.Error)
-				case result.Level < sendmail.WarnLevel:
-					log.WithFields(getLogFields(result.Fields)).Warn(result.Error)
-					w.WriteHeader(http.StatusInternalServerError)
-					fmt.Fprint(w, result.Error)
 				}
+				return
+			}
+			if err := logResults(envelope.Send()); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, err)
+			} else {
+				fmt.Fprint(w, "Send mail OK")
 			}
 		}
 	} else {
@@ -65,9 +84,17 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func startHTTP(bindAddr string) {
-	http.HandleFunc("/", handler)
+// startHTTP server in the background
+func startHTTP(bindAddr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handler)
+	s := &http.Server{Addr: bindAddr, Handler: mux}
 
 	log.Info("Starting HTTP server at ", bindAddr)
-	log.Fatal(http.ListenAndServe(bindAddr, nil))
+	go func() {
+		if err := s.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	return s
 }
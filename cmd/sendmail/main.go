@@ -5,10 +5,14 @@ import (
 	"bufio"
 	"bytes"
 	"flag"
+	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"strings"
+	"time"
 
+	smtp "github.com/emersion/go-smtp"
 	"github.com/n0madic/sendmail"
 	log "github.com/sirupsen/logrus"
 )
@@ -33,22 +37,78 @@ func (d *arrayDomains) Contains(str string) bool {
 	return false
 }
 
+// arrayStrings is a repeatable string flag
+type arrayStrings []string
+
+func (s *arrayStrings) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *arrayStrings) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
 var (
+	allowNetworks arrayNetworks
+	authFile      string
+	authRequired  bool
+	authTLS       bool
+	bounce        bool
+	checkConfig   bool
+	configFile    string
+	dane          sendmail.TLSAResolver
+	denyNetworks  arrayNetworks
+	daneMode      bool
+	dkimHeaders   arrayStrings
+	dkimKeyFlags  arrayStrings
+	dnsCacheStats time.Duration
+	dnsServer     string
+	explicitFlags = make(map[string]bool)
+	extract       bool
+	gracePeriod   time.Duration
 	httpMode      bool
 	httpBind      string
 	httpToken     string
-	ignored       bool
 	ignoreDot     bool
+	insecureAuth  bool
+	localDir      string
+	localDomains  arrayDomains
+	logFormat     string
+	mtasts        *sendmail.MTASTS
+	mtastsMode    bool
+	queue         *sendmail.Queue
+	queueDir      string
+	queueInterval time.Duration
+	queueLifetime time.Duration
+	resolver      sendmail.Resolver
 	sender        string
 	senderDomains arrayDomains
+	smtpAsync     bool
 	smtpMode      bool
 	smtpBind      string
+	smtpsBind     string
+	smtpTLSCert   string
+	smtpTLSKey    string
 	subject       string
+	tlsPolicy     sendmail.TLSPolicy
+	tlsPolicyName string
+	transportMap  string
+	trusted       arrayNetworks
 	verbose       bool
 )
 
+// Limits of the SMTP server, set by the configuration file
+var (
+	smtpReadTimeout     = 10 * time.Second
+	smtpWriteTimeout    = 10 * time.Second
+	smtpMaxMessageBytes = 1024 * 1024
+	smtpMaxRecipients   = 50
+	smtpWorkers         = 4
+)
+
 func main() {
-	flag.BoolVar(&ignored, "t", true, "Extract recipients from message headers. IGNORED")
+	flag.BoolVar(&extract, "t", false, "Extract recipients from To, Cc and Bcc headers, addresses given as arguments are excluded. Headers are used anyway without arguments.")
 	flag.BoolVar(&ignoreDot, "i", false, "When reading a message from standard input, don't treat a line with only a . character as the end of input.")
 	flag.BoolVar(&verbose, "v", false, "Enable verbose logging for debugging purposes.")
 	flag.StringVar(&sender, "f", "", "Set the envelope sender address.")
@@ -59,22 +119,184 @@ func main() {
 	flag.StringVar(&httpToken, "httpToken", "", "Use authorization token to receive mail (Token: header).")
 	flag.BoolVar(&smtpMode, "smtp", false, "Enable SMTP server mode.")
 	flag.StringVar(&smtpBind, "smtpBind", "localhost:25", "TCP or Unix address to SMTP listen on.")
+	flag.BoolVar(&smtpAsync, "smtpAsync", false, "Acknowledge DATA once the message is written to -queueDir and deliver it in the background.")
+	flag.StringVar(&smtpsBind, "smtpsBind", "", "TCP address to SMTP listen on with implicit TLS, e.g. :465 (disabled if empty).")
+	flag.StringVar(&smtpTLSCert, "smtpTLSCert", "", "Certificate file in PEM format for STARTTLS and implicit TLS of the SMTP server.")
+	flag.StringVar(&smtpTLSKey, "smtpTLSKey", "", "Private key file in PEM format of -smtpTLSCert.")
+	flag.StringVar(&authFile, "authFile", "", "File of SMTP AUTH users in htpasswd format with bcrypt hashes (htpasswd -B).")
+	flag.BoolVar(&authRequired, "authRequired", false, "Require SMTP AUTH before MAIL FROM.")
+	flag.BoolVar(&insecureAuth, "allowInsecureAuth", false, "Allow SMTP AUTH without TLS on non-local addresses.")
+	flag.BoolVar(&authTLS, "authRequireTLS", false, "Allow SMTP AUTH only over TLS, on local addresses too.")
 	flag.Var(&senderDomains, "senderDomain", "Domain of the sender from which mail is allowed (otherwise all domains). Can be repeated many times.")
+	flag.Var(&allowNetworks, "allowNetwork", "Network in CIDR notation from which HTTP/SMTP clients are allowed (otherwise all networks). Can be repeated many times.")
+	flag.Var(&denyNetworks, "denyNetwork", "Network in CIDR notation from which HTTP/SMTP clients are denied. Can be repeated many times.")
+	flag.Var(&trusted, "trustedNetwork", "Network in CIDR notation allowed to relay without authentication, besides loopback. Can be repeated many times.")
+	flag.Var(&localDomains, "localDomain", "Recipient domain accepted from untrusted clients without authentication. Can be repeated many times.")
+	flag.Var(&dkimKeyFlags, "dkimKey", "DKIM signing key of a sender domain as domain:selector:keyfile (PEM, RSA or Ed25519). Can be repeated many times.")
+	flag.Var(&dkimHeaders, "dkimHeader", "Header field to sign with DKIM (default From, Reply-To, Subject, Date, To, Cc, Message-ID and others). Can be repeated many times.")
+	flag.StringVar(&tlsPolicyName, "tlsPolicy", sendmail.TLSOpportunistic.String(), "TLS policy for outgoing connections: none, opportunistic, verify or require.")
+	flag.BoolVar(&mtastsMode, "mtaSts", false, "Honour MTA-STS policies of recipient domains.")
+	flag.BoolVar(&daneMode, "dane", false, "Verify MX certificates against DNSSEC authenticated TLSA records (requires a validating resolver).")
+	flag.StringVar(&dnsServer, "dnsServer", "", "DNS server address host:port for MX, address and TXT lookups (default system resolver, the first nameserver of /etc/resolv.conf in HTTP/SMTP server mode).")
+	flag.DurationVar(&dnsCacheStats, "dnsCacheStats", 10*time.Minute, "Interval of DNS cache statistics logging in HTTP/SMTP server mode (disabled if zero).")
+	flag.BoolVar(&bounce, "bounce", false, "Return delivery status notifications to the sender on permanent failure.")
+	flag.StringVar(&queueDir, "queueDir", "", "Spool directory for messages with temporary delivery failures (disabled if empty).")
+	flag.DurationVar(&queueInterval, "queueInterval", sendmail.DefaultQueueInterval, "Interval between queue runs in HTTP/SMTP server mode.")
+	flag.StringVar(&transportMap, "transportMap", "", "File with routing rules of recipient domains: \"domain transport\" lines.")
+	flag.StringVar(&localDir, "localDir", sendmail.DefaultLocalDir, "Directory of mailboxes for the local transport.")
+	flag.DurationVar(&queueLifetime, "queueLifetime", sendmail.DefaultQueueMaxLifetime, "Maximum time a message is kept in the queue.")
+
+	flag.StringVar(&configFile, "config", "", "Configuration file in YAML format (default "+DefaultConfigFile+" if exists). Flags override its values.")
+	flag.BoolVar(&checkConfig, "checkconfig", false, "Validate configuration and exit.")
+	flag.DurationVar(&gracePeriod, "shutdownTimeout", 30*time.Second, "Time to finish deliveries on SIGINT/SIGTERM in HTTP/SMTP server mode.")
+	flag.StringVar(&logFormat, "logFormat", "text", "Log format: text or json.")
 
 	flag.Parse()
 
+	if configFile == "" {
+		if _, err := os.Stat(DefaultConfigFile); err == nil {
+			configFile = DefaultConfigFile
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+	})
+	var config *fileConfig
+	if configFile != "" {
+		var err error
+		config, err = loadConfig(configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := config.apply(flag.CommandLine); err != nil {
+			log.Fatalf("%s: %v", configFile, err)
+		}
+		appliedFlags = config.flags()
+	}
+
 	if !verbose {
 		log.SetLevel(log.WarnLevel)
 	}
+	switch logFormat {
+	case "text":
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		log.Fatalf("unknown log format %s", logFormat)
+	}
+
+	var err error
+	tlsPolicy, err = sendmail.ParseTLSPolicy(tlsPolicyName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The servers query DNS directly to cache answers by their TTLs
+	if dnsServer != "" || httpMode || smtpMode {
+		resolver = &sendmail.DNSResolver{Server: dnsServer}
+	}
+
+	// Share DNS answers between messages received by the servers
+	var dnsCache *sendmail.CachingResolver
+	if httpMode || smtpMode {
+		dnsCache = sendmail.NewCachingResolver(resolver)
+		resolver = dnsCache
+	}
+
+	if mtastsMode {
+		mtasts = &sendmail.MTASTS{Resolver: resolver}
+	}
+
+	if daneMode {
+		dane = &sendmail.DNSResolver{Server: dnsServer}
+	}
+
+	if smtpTLSCert != "" || smtpTLSKey != "" {
+		if smtpTLSCert == "" || smtpTLSKey == "" {
+			log.Fatal("both -smtpTLSCert and -smtpTLSKey are required for TLS")
+		}
+		serverCert, err = loadCertificate(smtpTLSCert, smtpTLSKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if smtpsBind != "" && serverCert == nil {
+		log.Fatal("-smtpsBind requires -smtpTLSCert and -smtpTLSKey")
+	}
+	// AUTH would be impossible and every MAIL rejected
+	if authTLS && serverCert == nil {
+		log.Fatal("-authRequireTLS requires -smtpTLSCert and -smtpTLSKey")
+	}
+	if smtpMode && authRequired && serverCert == nil && !insecureAuth && !isLocalListener(smtpBind) {
+		log.Fatalf("-authRequired on %s requires -smtpTLSCert and -smtpTLSKey or -allowInsecureAuth", smtpBind)
+	}
+
+	initial, err := newSettings(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	currentSettings.Store(initial)
+
+	if queueDir != "" {
+		queue, err = sendmail.NewQueue(queueDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		queue.Interval = queueInterval
+		queue.MaxLifetime = queueLifetime
+		queue.Prepare = configureEnvelope
+	}
+	if smtpAsync && queue == nil {
+		log.Fatal("-smtpAsync requires -queueDir")
+	}
+
+	if os.Getenv("SENDMAIL_SMART_HOST") != "" {
+		pool, err := sendmail.EnvRelayPool()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, relay := range pool.Relays {
+			if err := sendmail.ValidateSmarthost(relay.URL); err != nil {
+				log.Fatalf("invalid smart host %q: %v", relay.URL, err)
+			}
+		}
+	}
+
+	if checkConfig {
+		fmt.Println("Configuration OK")
+		return
+	}
 
 	if httpMode || smtpMode {
+		go handleReload()
+		var queueDone chan struct{}
+		if queue != nil {
+			workers := 0
+			if smtpAsync {
+				workers = smtpWorkers
+			}
+			workersDone := startWorkers(workers, stopping)
+			queueDone = make(chan struct{})
+			go func() {
+				runQueue(queue, stopping)
+				<-workersDone
+				close(queueDone)
+			}()
+		}
+		if dnsCacheStats > 0 {
+			go logDNSCacheStats(dnsCache, dnsCacheStats)
+		}
+		var (
+			httpServer *http.Server
+			smtpServer *smtp.Server
+		)
 		if httpMode {
-			go startHTTP(httpBind)
+			httpServer = startHTTP(httpBind)
 		}
 		if smtpMode {
-			go startSMTP(smtpBind)
+			smtpServer = startSMTP(smtpBind, smtpsBind)
 		}
-		select {}
+		os.Exit(waitShutdown(httpServer, smtpServer, queueDone, gracePeriod))
 	} else {
 		stat, _ := os.Stdin.Stat()
 		if (stat.Mode() & os.ModeCharDevice) != 0 {
@@ -101,34 +323,42 @@ func main() {
 		}
 
 		envelope, err := sendmail.NewEnvelope(&sendmail.Config{
-			Sender:     sender,
-			Recipients: flag.Args(),
-			Subject:    subject,
-			Body:       body,
+			Sender:            sender,
+			Recipients:        flag.Args(),
+			Subject:           subject,
+			Body:              body,
+			ExtractRecipients: extract,
 		})
 		if err != nil {
 			log.Fatal(err)
 		}
+		configureEnvelope(&envelope)
 
 		senderDomain := sendmail.GetDomainFromAddress(envelope.Header["From"][0])
-		if len(senderDomains) > 0 && !senderDomains.Contains(senderDomain) {
+		if domains := current().senderDomains; len(domains) > 0 && !domains.Contains(senderDomain) {
 			log.Fatalf("Attempt to unauthorized send with domain %s", senderDomain)
 		}
 
-		errs := envelope.Send()
-		for result := range errs {
-			switch {
-			case result.Level > sendmail.WarnLevel:
-				log.WithFields(getLogFields(result.Fields)).Info(result.Message)
-			case result.Level == sendmail.WarnLevel:
-				log.WithFields(getLogFields(result.Fields)).Warn(result.Error)
-			case result.Level < sendmail.WarnLevel:
-				log.WithFields(getLogFields(result.Fields)).Fatal(result.Error)
-			}
+		if err := logResults(envelope.Send()); err != nil {
+			os.Exit(1)
 		}
 	}
 }
 
+// configureEnvelope apply delivery settings to envelope
+func configureEnvelope(envelope *sendmail.Envelope) {
+	envelope.Queue = queue
+	envelope.Bounce = bounce
+	envelope.TLSPolicy = tlsPolicy
+	envelope.Resolver = resolver
+	settings := current()
+	envelope.Transports = settings.transports
+	envelope.Relays = settings.relays
+	envelope.DKIM = settings.dkim
+	envelope.MTASTS = mtasts
+	envelope.DANE = dane
+}
+
 func getLogFields(fields sendmail.Fields) log.Fields {
 	logFields := log.Fields{}
 	if verbose {
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/n0madic/sendmail"
+	log "github.com/sirupsen/logrus"
+)
+
+// runQueue retry deferred messages until stop is closed
+func runQueue(queue *sendmail.Queue, stop <-chan struct{}) {
+	log.Info("Starting queue runner at ", queue.Dir)
+	for result := range queue.Run(stop) {
+		logResult(result)
+	}
+}
+
+// logResult log result of a background delivery
+func logResult(result sendmail.Result) {
+	switch {
+	case result.Level > sendmail.WarnLevel:
+		log.WithFields(getLogFields(result.Fields)).Info(result.Message)
+	case result.Level == sendmail.WarnLevel:
+		log.WithFields(getLogFields(result.Fields)).Warn(result.Error)
+	case result.Level < sendmail.WarnLevel:
+		log.WithFields(getLogFields(result.Fields)).Error(result.Error)
+	}
+}
+
+// logResults log all results of a delivery and return the error
+// of the final summary, deferred recipients are not an error if queued
+func logResults(results <-chan sendmail.Result) error {
+	var err error
+	for result := range results {
+		logResult(result)
+		err = nil
+		if result.Level < sendmail.WarnLevel {
+			err = result.Error
+		}
+	}
+	return err
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/n0madic/sendmail"
+	log "github.com/sirupsen/logrus"
+)
+
+// settings which are replaced on SIGHUP without restarting the servers
+type settings struct {
+	senderDomains arrayDomains
+	auth          Authenticator
+	access        *accessList
+	dkim          *sendmail.DKIM
+	relays        *sendmail.RelayPool
+	transports    *sendmail.TransportMap
+}
+
+var currentSettings atomic.Value
+
+// appliedFlags are the file values of flags applied on start,
+// changes of them take effect on restart
+var appliedFlags map[string][]string
+
+// current return settings in effect
+func current() *settings {
+	return currentSettings.Load().(*settings)
+}
+
+// newSettings build settings from flags and the configuration file (optional),
+// flags set on the command line take precedence.
+func newSettings(config *fileConfig) (*settings, error) {
+	if config == nil {
+		config = &fileConfig{}
+	}
+	s := &settings{
+		senderDomains: senderDomains,
+	}
+	if !explicitFlags["senderDomain"] {
+		s.senderDomains = config.SenderDomains
+	}
+
+	// networks return the flag value if it is set, otherwise the file value
+	networks := func(name string, flagValue arrayNetworks, fileValue []string) (arrayNetworks, error) {
+		if explicitFlags[name] {
+			return flagValue, nil
+		}
+		return parseNetworks(fileValue)
+	}
+	s.access = &accessList{localDomains: localDomains}
+	var err error
+	if s.access.allow, err = networks("allowNetwork", allowNetworks, config.Access.Allow); err != nil {
+		return nil, err
+	}
+	if s.access.deny, err = networks("denyNetwork", denyNetworks, config.Access.Deny); err != nil {
+		return nil, err
+	}
+	if s.access.trusted, err = networks("trustedNetwork", trusted, config.Access.Trusted); err != nil {
+		return nil, err
+	}
+	if !explicitFlags["localDomain"] {
+		s.access.localDomains = config.Access.LocalDomains
+	}
+
+	users, usersFile := 0, authFile
+	if !explicitFlags["authFile"] && config.Auth.File != "" {
+		usersFile = config.Auth.File
+	}
+	if usersFile != "" || len(config.Auth.Users) > 0 {
+		db, err := newUserDB(config.Auth.Users, config.Auth.Senders)
+		if err != nil {
+			return nil, err
+		}
+		if usersFile != "" {
+			if err := db.loadHtpasswd(usersFile); err != nil {
+				return nil, err
+			}
+		}
+		s.auth, users = db, len(db.hashes)
+	}
+	if authRequired && users == 0 {
+		return nil, errors.New("-authRequired requires users in -authFile or auth.users")
+	}
+
+	dkimKeys, headers := config.DKIM.Keys, config.DKIM.Headers
+	if explicitFlags["dkimKey"] {
+		dkimKeys = nil
+		for _, value := range dkimKeyFlags {
+			key, err := parseDKIMKey(value)
+			if err != nil {
+				return nil, err
+			}
+			dkimKeys = append(dkimKeys, key)
+		}
+	}
+	if explicitFlags["dkimHeader"] {
+		headers = dkimHeaders
+	}
+	if s.dkim, err = newDKIM(dkimKeys, headers); err != nil {
+		return nil, err
+	}
+
+	// SENDMAIL_SMART_HOST takes precedence over the file
+	if len(config.SmartHosts) > 0 && os.Getenv("SENDMAIL_SMART_HOST") == "" {
+		var hosts []sendmail.Relay
+		for _, host := range config.SmartHosts {
+			if err := sendmail.ValidateSmarthost(host.URL); err != nil {
+				return nil, fmt.Errorf("invalid smart host %q: %v", host.URL, err)
+			}
+			weight := host.Weight
+			if weight == 0 {
+				weight = 1
+			}
+			hosts = append(hosts, sendmail.Relay{
+				URL:      host.URL,
+				Priority: host.Priority,
+				Weight:   weight,
+				Credentials: sendmail.Credentials{
+					Login:     host.Login,
+					Password:  host.Password,
+					Mechanism: host.Auth,
+					Token:     host.Token,
+					TokenFile: host.TokenFile,
+				},
+			})
+		}
+		s.relays = sendmail.NewRelayPool(hosts...)
+	}
+
+	mapFile, mailDir := transportMap, localDir
+	if !explicitFlags["transportMap"] && config.TransportMap != "" {
+		mapFile = config.TransportMap
+	}
+	if !explicitFlags["localDir"] && config.LocalDir != "" {
+		mailDir = config.LocalDir
+	}
+	if mapFile != "" {
+		f, err := os.Open(mapFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		s.transports, err = sendmail.ParseTransportMap(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", mapFile, err)
+		}
+		s.transports.LocalDir = mailDir
+	}
+	return s, nil
+}
+
+// relayPools return pools of the smart hosts and of the transport map routes
+func (s *settings) relayPools() []*sendmail.RelayPool {
+	var pools []*sendmail.RelayPool
+	if s.relays != nil {
+		pools = append(pools, s.relays)
+	}
+	if s.transports != nil {
+		for _, transport := range s.transports.Routes {
+			if transport.Relays != nil {
+				pools = append(pools, transport.Relays)
+			}
+		}
+	}
+	return pools
+}
+
+// reload read the configuration file and the server certificate again
+// and swap the settings, the old settings are kept on error.
+func reload() error {
+	var config *fileConfig
+	if configFile != "" {
+		var err error
+		config, err = loadConfig(configFile)
+		if err != nil {
+			return err
+		}
+	}
+	s, err := newSettings(config)
+	if err != nil {
+		return err
+	}
+	// Relays which are still configured keep their health
+	for _, pool := range s.relayPools() {
+		for _, old := range current().relayPools() {
+			pool.CopyHealth(old)
+		}
+	}
+	// The certificate is replaced, TLS is enabled or disabled on restart only
+	reloaded := make(map[string]bool)
+	if serverCert != nil {
+		certFile, keyFile := certificateFiles(config)
+		if certFile == "" || keyFile == "" {
+			certFile, keyFile = serverCert.certFile, serverCert.keyFile
+		} else {
+			reloaded["smtpTLSCert"], reloaded["smtpTLSKey"] = true, true
+		}
+		if err := serverCert.load(certFile, keyFile); err != nil {
+			return err
+		}
+	}
+	currentSettings.Store(s)
+	warnRestart(config, reloaded)
+	return nil
+}
+
+// certificateFiles return certificate and key files of the SMTP server,
+// flags set on the command line take precedence over the file
+func certificateFiles(config *fileConfig) (string, string) {
+	certFile, keyFile := smtpTLSCert, smtpTLSKey
+	if config != nil {
+		if !explicitFlags["smtpTLSCert"] {
+			certFile = config.SMTP.TLSCert
+		}
+		if !explicitFlags["smtpTLSKey"] {
+			keyFile = config.SMTP.TLSKey
+		}
+	}
+	return certFile, keyFile
+}
+
+// warnRestart log file values of flags changed since the start
+// which are not reloaded
+func warnRestart(config *fileConfig, reloaded map[string]bool) {
+	if config == nil {
+		config = &fileConfig{}
+	}
+	values := config.flags()
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	for name := range appliedFlags {
+		if _, ok := values[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if explicitFlags[name] || reloaded[name] {
+			continue
+		}
+		if strings.Join(values[name], ",") != strings.Join(appliedFlags[name], ",") {
+			log.Warnf("%s: -%s changed, restart to apply", configFile, name)
+		}
+	}
+}
+
+// handleReload reload settings on SIGHUP
+func handleReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := reload(); err != nil {
+			log.Error("Reload failed: ", err)
+			continue
+		}
+		log.Info("Configuration reloaded")
+	}
+}
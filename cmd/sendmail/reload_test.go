@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/n0madic/sendmail/test"
+)
+
+// writeCertificate write self-signed certificate of host and its key,
+// it returns the file names and the certificate in DER format
+func writeCertificate(t *testing.T, dir, host string) (string, string, []byte) {
+	t.Helper()
+	cert, err := test.SelfSignedCertificate(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, host+".crt"), filepath.Join(dir, host+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert.Certificate[0]
+}
+
+func TestReloadFiles(t *testing.T) {
+	dir := t.TempDir()
+	oldCert, oldKey, _ := writeCertificate(t, dir, "old.example.com")
+	newCert, newKey, newDER := writeCertificate(t, dir, "new.example.com")
+	oldUsers, newUsers := filepath.Join(dir, "old.htpasswd"), filepath.Join(dir, "new.htpasswd")
+	if err := ioutil.WriteFile(oldUsers, []byte("old:"+testHash(t, "secret")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(newUsers, []byte("new:"+testHash(t, "secret")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(file string, cert *certificate) { configFile, serverCert = file, cert }(configFile, serverCert)
+	configFile = writeConfig(t, "auth:\n  file: "+oldUsers+"\nsmtp:\n  tls_cert: "+oldCert+"\n  tls_key: "+oldKey+"\n")
+	config, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial, err := newSettings(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentSettings.Store(initial)
+	if serverCert, err = loadCertificate(oldCert, oldKey); err != nil {
+		t.Fatal(err)
+	}
+
+	content := "auth:\n  file: " + newUsers + "\nsmtp:\n  tls_cert: " + newCert + "\n  tls_key: " + newKey + "\n"
+	if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := current().auth.Authenticate("new", "secret"); err != nil {
+		t.Error("Expected user of the new auth file, got", err)
+	}
+	if err := current().auth.Authenticate("old", "secret"); err == nil {
+		t.Error("Expected user of the old auth file to be removed")
+	}
+	cert, err := serverCert.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cert.Certificate[0], newDER) {
+		t.Error("Expected certificate of the new files")
+	}
+
+	// The previous certificate is kept if the new files are invalid
+	content = "smtp:\n  tls_cert: " + oldKey + "\n  tls_key: " + oldCert + "\n"
+	if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reload(); err == nil {
+		t.Error("Expected error for invalid certificate")
+	}
+	if serverCert.certFile != newCert || serverCert.keyFile != newKey {
+		t.Error("Expected files of the previous certificate, got", serverCert.certFile, serverCert.keyFile)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	smtp "github.com/emersion/go-smtp"
+	"github.com/n0madic/sendmail"
+	log "github.com/sirupsen/logrus"
+)
+
+// stopping is closed when shutdown begins
+var stopping = make(chan struct{})
+
+// isStopping reports whether the servers are shutting down
+func isStopping() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// spool accept message to the queue instead of delivering it during
+// shutdown, it is delivered by the queue runner after the restart.
+// It reports false if there is no queue.
+func spool(envelope *sendmail.Envelope, body []byte) (bool, error) {
+	if queue == nil || !isStopping() {
+		return false, nil
+	}
+	id, err := queue.Accept(envelope)
+	if err != nil {
+		return true, err
+	}
+	log.WithFields(getLogFields(sendmail.Fields{
+		"sender":     envelope.Header.Get("From"),
+		"recipients": envelope.Recipients,
+		"queue_id":   id,
+	})).Info("Spooled on shutdown")
+	return true, nil
+}
+
+// waitShutdown block until SIGINT or SIGTERM, then stop accepting
+// connections and wait for handlers and the queue runner until timeout.
+// It returns exit status, non-zero if the deadline was exceeded.
+func waitShutdown(httpServer *http.Server, smtpServer *smtp.Server, queueDone <-chan struct{}, timeout time.Duration) int {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Info("Shutting down on ", sig)
+	close(stopping)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	status := 0
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Error("HTTP server shutdown: ", err)
+			httpServer.Close()
+			status = 1
+		}
+	}
+	if smtpServer != nil {
+		if err := smtpServer.Shutdown(ctx); err != nil {
+			log.Error("SMTP server shutdown: ", err)
+			smtpServer.Close()
+			status = 1
+		}
+	}
+	if queueDone != nil {
+		select {
+		case <-queueDone:
+		case <-ctx.Done():
+			log.Error("Queue runner shutdown: ", ctx.Err())
+			status = 1
+		}
+	}
+	if status == 0 {
+		log.Info("Shutdown complete")
+	}
+	return status
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/mail"
 	"strings"
-	"time"
 
+	"github.com/emersion/go-sasl"
 	smtp "github.com/emersion/go-smtp"
 	"github.com/n0madic/sendmail"
 	log "github.com/sirupsen/logrus"
@@ -15,25 +18,81 @@ import (
 // The Backend implements SMTP server methods.
 type Backend struct{}
 
-func (bkd *Backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
-	return &Session{}, nil
+func (bkd *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	ip := clientIP(c.Conn().RemoteAddr().String())
+	if !current().access.allowed(ip) {
+		log.Errorf("Connection from denied address %s", ip)
+		return nil, &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "access denied",
+		}
+	}
+	return &Session{IP: ip}, nil
 }
 
 // A Session is returned after successful login.
 type Session struct {
 	From string
 	To   []string
+	// User authenticated by AUTH
+	User string
+	// IP address of the client, nil for Unix sockets
+	IP net.IP
+}
+
+// AuthMechanisms supported by the server, none without an authenticator
+func (s *Session) AuthMechanisms() []string {
+	if current().auth == nil {
+		return nil
+	}
+	return []string{sasl.Plain}
 }
 
-// AuthPlain check stub
+// Auth return server of the mechanism
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	if mech != sasl.Plain || current().auth == nil {
+		return nil, smtp.ErrAuthUnknownMechanism
+	}
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		if identity != "" && identity != username {
+			return smtp.ErrAuthFailed
+		}
+		return s.AuthPlain(username, password)
+	}), nil
+}
+
+// AuthPlain check credentials with the authenticator
 func (s *Session) AuthPlain(username, password string) error {
+	auth := current().auth
+	if auth == nil {
+		return smtp.ErrAuthUnsupported
+	}
+	if err := auth.Authenticate(username, password); err != nil {
+		log.Errorf("Authentication failed for user %s", username)
+		return smtp.ErrAuthFailed
+	}
+	s.User = username
 	return nil
 }
 
 // Mail save sender
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	if s.User == "" && authRequired {
+		return smtp.ErrAuthRequired
+	}
+	if s.User != "" {
+		if auth := current().auth; auth != nil && !auth.AllowedSender(s.User, from) {
+			log.Errorf("User %s is not allowed to send as %s", s.User, from)
+			return &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      fmt.Sprintf("sender %s not allowed for user %s", from, s.User),
+			}
+		}
+	}
 	senderDomain := sendmail.GetDomainFromAddress(from)
-	if len(senderDomains) > 0 && !senderDomains.Contains(senderDomain) {
+	if domains := current().senderDomains; len(domains) > 0 && !domains.Contains(senderDomain) {
 		log.Errorf("Attempt to unauthorized send with domain %s", senderDomain)
 		return fmt.Errorf("unauthorized sender domain %s", senderDomain)
 	}
@@ -41,9 +100,32 @@ func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 	return nil
 }
 
-// Rcpt save recipients
+// Rcpt add recipient to the transaction
 func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
-	s.To = strings.Split(to, ",")
+	// The local part is passed unquoted, it is quoted again if needed
+	rcpt := strings.Trim((&mail.Address{Address: to}).String(), "<>")
+	addr, err := mail.ParseAddress(rcpt)
+	if err != nil || sendmail.GetDomainFromAddress(addr.Address) == "" {
+		return &smtp.SMTPError{
+			Code:         553,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+			Message:      fmt.Sprintf("invalid recipient address %s", to),
+		}
+	}
+	if !current().access.relayAllowed(s.IP, s.User != "", addr.Address) {
+		log.Errorf("Relay access denied for %s to %s", s.IP, to)
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("relay access denied for %s", to),
+		}
+	}
+	for _, other := range s.To {
+		if parsed, err := mail.ParseAddress(other); err == nil && strings.EqualFold(parsed.Address, addr.Address) {
+			return nil
+		}
+	}
+	s.To = append(s.To, rcpt)
 	return nil
 }
 
@@ -61,44 +143,82 @@ func (s *Session) Data(r io.Reader) error {
 	if err != nil {
 		return err
 	}
-	envelope.Send()
-	errs := envelope.Send()
-	for result := range errs {
-		switch {
-		case result.Level > sendmail.WarnLevel:
-			log.WithFields(getLogFields(result.Fields)).Info(result.Message)
-		case result.Level == sendmail.WarnLevel:
-			log.WithFields(getLogFields(result.Fields)).Warn(result.Error)
-		case result.Level < sendmail.WarnLevel:
-			log.WithFields(getLogFields(result.Fields)).Warn(result.Error)
-			return result.Error
+	configureEnvelope(&envelope)
+	if smtpAsync {
+		id, err := accept(&envelope)
+		if err != nil {
+			log.Error(err)
+			return &smtp.SMTPError{
+				Code:         451,
+				EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+				Message:      "unable to queue message",
+			}
+		}
+		return &smtp.SMTPError{
+			Code:         250,
+			EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+			Message:      "OK: queued as " + id,
 		}
 	}
-	return nil
+	if spooled, err := spool(&envelope, body); spooled {
+		return err
+	}
+	return logResults(envelope.Send())
 }
 
-// Reset session
-func (s *Session) Reset() {}
+// Reset discard sender and recipients on RSET and after DATA,
+// the authenticated user is kept
+func (s *Session) Reset() {
+	s.From = ""
+	s.To = nil
+}
 
 // Logout session
 func (s *Session) Logout() error {
 	return nil
 }
 
-// Start SMTP server
-func startSMTP(bindAddr string) {
+// startSMTP server in the background, with an implicit TLS listener
+// on smtpsAddr if it is not empty
+func startSMTP(bindAddr, smtpsAddr string) *smtp.Server {
 	be := &Backend{}
 
 	s := smtp.NewServer(be)
 
 	s.Addr = bindAddr
 	s.Domain = "sendmail"
-	s.ReadTimeout = 10 * time.Second
-	s.WriteTimeout = 10 * time.Second
-	s.MaxMessageBytes = 1024 * 1024
-	s.MaxRecipients = 50
-	s.AllowInsecureAuth = true
+	s.ReadTimeout = smtpReadTimeout
+	s.WriteTimeout = smtpWriteTimeout
+	s.MaxMessageBytes = int64(smtpMaxMessageBytes)
+	s.MaxRecipients = smtpMaxRecipients
+	if serverCert != nil {
+		// STARTTLS is offered when the config is set
+		s.TLSConfig = serverCert.tlsConfig()
+	}
+	// Credentials are sent in clear text without TLS
+	s.AllowInsecureAuth = !authTLS && (insecureAuth || isLocalListener(bindAddr))
 
+	if settings := current(); !isLocalListener(bindAddr) && !authRequired && len(settings.senderDomains) == 0 &&
+		len(settings.access.allow) == 0 && len(settings.access.localDomains) == 0 {
+		log.Warnf("SMTP server at %s relays mail from anyone, use -authRequired, -allowNetwork or -localDomain", bindAddr)
+	}
 	log.Info("Starting SMTP server at ", s.Addr)
-	log.Fatal(s.ListenAndServe())
+	go func() {
+		if err := s.ListenAndServe(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	if smtpsAddr != "" {
+		log.Info("Starting SMTPS server at ", smtpsAddr)
+		l, err := tls.Listen("tcp", smtpsAddr, s.TLSConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := s.Serve(l); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	return s
 }
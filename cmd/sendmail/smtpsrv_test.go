@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gosmtp "github.com/emersion/go-smtp"
+	"github.com/n0madic/sendmail"
+)
+
+// remoteListener pretends that clients connect from addr
+type remoteListener struct {
+	net.Listener
+	addr net.Addr
+}
+
+func (l remoteListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return remoteConn{conn, l.addr}, nil
+}
+
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// startTestSMTP serve the Backend to an untrusted client,
+// messages to local.test are delivered to mailboxes in the returned directory
+func startTestSMTP(t *testing.T) (*smtp.Client, string) {
+	t.Helper()
+	dir := t.TempDir()
+	transports, err := sendmail.ParseTransportMap(strings.NewReader("local.test local\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transports.LocalDir = dir
+	currentSettings.Store(&settings{
+		access:     &accessList{localDomains: arrayDomains{"local.test"}},
+		transports: transports,
+	})
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := gosmtp.NewServer(&Backend{})
+	s.Domain = "localhost"
+	go s.Serve(remoteListener{l, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}})
+	t.Cleanup(func() { s.Close() })
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, dir
+}
+
+func sendData(t *testing.T, c *smtp.Client) {
+	t.Helper()
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("Subject: test\r\n\r\nTEST\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mailboxMessages return number of messages in the mailbox of user
+func mailboxMessages(t *testing.T, dir, user string) int {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(dir, user))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "\nSubject: test\n")
+}
+
+func replyCode(err error) int {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code
+	}
+	return 0
+}
+
+func TestSessionRcpt(t *testing.T) {
+	c, dir := startTestSMTP(t)
+
+	if err := c.Mail("sender@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		rcpt string
+		code int
+	}{
+		{"a@local.test", 0},
+		{"b@local.test", 0},
+		// Repeated recipients are accepted once
+		{"A@Local.test", 0},
+		{"a@local.test", 0},
+		{`"john doe"@local.test`, 0},
+		{"a@b@local.test", 553},
+		{"user@local..test", 553},
+		{"user@remote.test", 554},
+	}
+	for _, tt := range tests {
+		if code := replyCode(c.Rcpt(tt.rcpt)); code != tt.code {
+			t.Errorf("RCPT TO %s: expected code %d, got %d", tt.rcpt, tt.code, code)
+		}
+	}
+	if err := c.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recipients of the reset transaction are discarded
+	if err := c.Mail("sender@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"a@local.test", "b@local.test", "a@local.test"} {
+		if err := c.Rcpt(rcpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sendData(t, c)
+
+	// Recipients of the delivered transaction are discarded
+	if err := c.Mail("sender@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("c@local.test"); err != nil {
+		t.Fatal(err)
+	}
+	sendData(t, c)
+
+	expected := map[string]int{"a": 1, "b": 1, "c": 1, `"john doe"`: 0}
+	for user, n := range expected {
+		if messages := mailboxMessages(t, dir, user); messages != n {
+			t.Errorf("Expected %d messages for %s, got %d", n, user, messages)
+		}
+	}
+}
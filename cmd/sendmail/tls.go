@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/tls"
+	"sync/atomic"
+)
+
+// certificate of the SMTP server which is read again on SIGHUP
+type certificate struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Value // *tls.Certificate
+}
+
+// serverCert is nil if TLS is not configured
+var serverCert *certificate
+
+// loadCertificate read certificate and key in PEM format
+func loadCertificate(certFile, keyFile string) (*certificate, error) {
+	c := &certificate{}
+	if err := c.load(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load read certificate and key files, which may differ from the previous
+// ones on reload, the previous certificate is kept on error
+func (c *certificate) load(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	c.certFile, c.keyFile = certFile, keyFile
+	c.cert.Store(&cert)
+	return nil
+}
+
+func (c *certificate) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load().(*tls.Certificate), nil
+}
+
+// tlsConfig return server configuration which always uses the current certificate
+func (c *certificate) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: c.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
@@ -0,0 +1,120 @@
+package sendmail
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// TLSA certificate usages usable for SMTP (RFC 7672)
+const (
+	// TLSAUsageDANETA is a trust anchor for the server certificate chain
+	TLSAUsageDANETA uint8 = 2
+	// TLSAUsageDANEEE is the server certificate itself
+	TLSAUsageDANEEE uint8 = 3
+)
+
+// errDANEMismatch is returned when the server certificate does not match TLSA records
+var errDANEMismatch = errors.New("server certificate does not match TLSA records")
+
+// lookupDANE return usable TLSA records of the MX host, nil if DANE does
+// not apply. DANE applies only when the records are DNSSEC authenticated.
+func (e *Envelope) lookupDANE(host string) ([]TLSA, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultDNSTimeout)
+	defer cancel()
+	records, secure, err := e.DANE.LookupTLSA(ctx, fmt.Sprintf("_%s._tcp.%s", e.PortSMTP, host))
+	if err != nil || !secure {
+		return nil, err
+	}
+	var usable []TLSA
+	for _, record := range records {
+		if record.Usage == TLSAUsageDANETA || record.Usage == TLSAUsageDANEEE {
+			usable = append(usable, record)
+		}
+	}
+	return usable, nil
+}
+
+// daneConfig return TLS config which verifies the server certificate
+// of host against TLSA records instead of the system roots.
+func daneConfig(host string, records []TLSA) *tls.Config {
+	return &tls.Config{
+		ServerName: host,
+		// The chain is verified by VerifyConnection
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if verifyTLSA(host, state.PeerCertificates, records) {
+				return nil
+			}
+			return errDANEMismatch
+		},
+	}
+}
+
+// verifyTLSA reports whether the certificate chain presented by host
+// matches at least one of the TLSA records.
+func verifyTLSA(host string, certs []*x509.Certificate, records []TLSA) bool {
+	if len(certs) == 0 {
+		return false
+	}
+	for _, record := range records {
+		switch record.Usage {
+		case TLSAUsageDANEEE:
+			// Neither the name nor the validity period are checked
+			if matchTLSA(certs[0], record) {
+				return true
+			}
+		case TLSAUsageDANETA:
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			for _, anchor := range certs[1:] {
+				if !matchTLSA(anchor, record) {
+					continue
+				}
+				roots := x509.NewCertPool()
+				roots.AddCert(anchor)
+				_, err := certs[0].Verify(x509.VerifyOptions{
+					DNSName:       host,
+					Roots:         roots,
+					Intermediates: intermediates,
+				})
+				if err == nil {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// matchTLSA reports whether the certificate matches the TLSA record
+func matchTLSA(cert *x509.Certificate, record TLSA) bool {
+	var data []byte
+	switch record.Selector {
+	case 0:
+		data = cert.Raw
+	case 1:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+	switch record.MatchingType {
+	case 0:
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(data, record.Data)
+}
@@ -0,0 +1,104 @@
+package sendmail_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/test"
+)
+
+func tlsaZone(data string) map[string][]dns.RR {
+	return map[string][]dns.RR{
+		"_" + test.PortSMTPTLS + "._tcp.localhost.": {&dns.TLSA{
+			Hdr: dns.RR_Header{
+				Name:   "_" + test.PortSMTPTLS + "._tcp.localhost.",
+				Rrtype: dns.TypeTLSA,
+				Class:  dns.ClassINET,
+				Ttl:    300,
+			},
+			Usage:        sendmail.TLSAUsageDANEEE,
+			Selector:     1,
+			MatchingType: 1,
+			Certificate:  data,
+		}},
+	}
+}
+
+func certificateSPKIHash() string {
+	sum := sha256.Sum256(test.Certificate().Leaf.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestDNSResolverLookupTLSA(t *testing.T) {
+	addr, stop := test.StartDNS(tlsaZone(certificateSPKIHash()), true)
+	defer stop()
+
+	resolver := &sendmail.DNSResolver{Server: addr}
+	records, secure, err := resolver.LookupTLSA(context.Background(), "_"+test.PortSMTPTLS+"._tcp.localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !secure {
+		t.Error("Expected authenticated answer")
+	}
+	if len(records) != 1 || records[0].Usage != sendmail.TLSAUsageDANEEE || hex.EncodeToString(records[0].Data) != certificateSPKIHash() {
+		t.Error("Unexpected records", records)
+	}
+
+	records, _, err = resolver.LookupTLSA(context.Background(), "_25._tcp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Error("Expected no records, got", records)
+	}
+}
+
+func TestSendLikeMTAWithDANE(t *testing.T) {
+	go test.StartSMTPTLS()
+	test.WaitPort(test.PortSMTPTLS)
+
+	tests := []struct {
+		name          string
+		data          string
+		authenticated bool
+		delivered     bool
+		dane          bool
+	}{
+		{"match", certificateSPKIHash(), true, true, true},
+		{"mismatch", hex.EncodeToString(make([]byte, sha256.Size)), true, false, true},
+		{"insecure", hex.EncodeToString(make([]byte, sha256.Size)), false, true, false},
+	}
+	for _, tt := range tests {
+		addr, stop := test.StartDNS(tlsaZone(tt.data), tt.authenticated)
+
+		config := testConfigs[0].initial
+		config.PortSMTP = test.PortSMTPTLS
+		envelope, err := sendmail.NewEnvelope(&config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelope.DANE = &sendmail.DNSResolver{Server: addr}
+
+		delivered := false
+		for result := range envelope.SendLikeMTA() {
+			if result.Level == sendmail.InfoLevel && result.Fields["recipient"] == "recipient@localhost" {
+				delivered = true
+				if (result.Fields["dane"] == true) != tt.dane {
+					t.Error(tt.name, "expected dane", tt.dane, "got", result.Fields["dane"])
+				}
+				if tt.dane && result.Fields["tls_verified"] != true {
+					t.Error(tt.name, "expected verified TLS")
+				}
+			}
+		}
+		if delivered != tt.delivered {
+			t.Error(tt.name, "expected delivered", tt.delivered, "got", delivered)
+		}
+		stop()
+	}
+}
@@ -0,0 +1,262 @@
+package sendmail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDKIMHeaders are signed if DKIM.Headers is empty
+var DefaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Message-ID", "In-Reply-To", "References",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// DKIMKey is the private key of a selector
+type DKIMKey struct {
+	Selector string
+	// Signer is *rsa.PrivateKey or ed25519.PrivateKey
+	Signer crypto.Signer
+}
+
+// DKIM signs messages with the key of the From domain (RFC 6376),
+// canonicalization is relaxed/relaxed.
+type DKIM struct {
+	// Keys by sender domain, messages of other domains are not signed
+	Keys map[string]*DKIMKey
+	// Headers to sign, DefaultDKIMHeaders if empty. From is always signed.
+	Headers []string
+}
+
+// LoadDKIMKey read RSA or Ed25519 private key from PEM file
+// in PKCS #1 or PKCS #8 format
+func LoadDKIMKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported key type %T", path, key)
+}
+
+// Sign return message with DKIM-Signature field prepended,
+// the message is returned unchanged if there is no key of the From domain.
+// Bare LF line endings are replaced with CRLF as they are sent.
+func (d *DKIM) Sign(message []byte) ([]byte, error) {
+	message = toCRLF(message)
+	end := bytes.Index(message, []byte("\r\n\r\n"))
+	if end < 0 {
+		return nil, errors.New("message without header")
+	}
+	fields := splitHeaderFields(message[:end+2])
+	body := message[end+4:]
+
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return nil, err
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return nil, fmt.Errorf("DKIM: %v", err)
+	}
+	domain := strings.ToLower(GetDomainFromAddress(from.Address))
+	key := d.Keys[domain]
+	if key == nil {
+		return message, nil
+	}
+	var algorithm string
+	switch key.Signer.(type) {
+	case *rsa.PrivateKey:
+		algorithm = "rsa-sha256"
+	case ed25519.PrivateKey:
+		algorithm = "ed25519-sha256"
+	default:
+		return nil, fmt.Errorf("DKIM: unsupported key type %T", key.Signer)
+	}
+
+	names := d.Headers
+	if len(names) == 0 {
+		names = DefaultDKIMHeaders
+	}
+	if !containsFold(names, "From") {
+		names = append([]string{"From"}, names...)
+	}
+
+	hash := sha256.New()
+	var signed []string
+	// Instances of a field are signed from the bottom up (RFC 6376 5.4.2)
+	used := make(map[int]bool)
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fieldName(fields[i]), name) {
+				continue
+			}
+			used[i] = true
+			hash.Write([]byte(relaxedHeader(fields[i])))
+			signed = append(signed, strings.ToLower(name))
+		}
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	field := foldHeader("DKIM-Signature: " + strings.Join([]string{
+		"v=1",
+		"a=" + algorithm,
+		"c=relaxed/relaxed",
+		"d=" + domain,
+		"s=" + key.Selector,
+		"t=" + strconv.FormatInt(time.Now().Unix(), 10),
+		"h=" + strings.Join(signed, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b=",
+	}, "; "))
+	// The signature field itself is hashed with empty b= and without CRLF
+	hash.Write([]byte(strings.TrimSuffix(relaxedHeader(field), "\r\n")))
+
+	var signature []byte
+	if _, ok := key.Signer.(ed25519.PrivateKey); ok {
+		// Ed25519 signs the hash (RFC 8463)
+		signature, err = key.Signer.Sign(rand.Reader, hash.Sum(nil), crypto.Hash(0))
+	} else {
+		signature, err = key.Signer.Sign(rand.Reader, hash.Sum(nil), crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString(field)
+	encoded := base64.StdEncoding.EncodeToString(signature)
+	// Folding whitespace inside b= is ignored by verifiers
+	n := maxHeaderLine - (len(field) - strings.LastIndex(field, "\n") - 1)
+	if n < 0 {
+		n = 0
+	}
+	for len(encoded) > n {
+		buf.WriteString(encoded[:n] + "\r\n ")
+		encoded = encoded[n:]
+		n = maxHeaderLine - 1
+	}
+	buf.WriteString(encoded + "\r\n")
+	buf.Write(message)
+	return buf.Bytes(), nil
+}
+
+// signedMessage return generated message signed with DKIM if it is set
+func (e *Envelope) signedMessage() ([]byte, error) {
+	message, err := e.GenerateMessage()
+	if err != nil || e.DKIM == nil {
+		return message, err
+	}
+	return e.DKIM.Sign(message)
+}
+
+// splitHeaderFields return raw fields of header with folded lines
+func splitHeaderFields(header []byte) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+func fieldName(field string) string {
+	if i := strings.IndexByte(field, ':'); i >= 0 {
+		return strings.TrimSpace(field[:i])
+	}
+	return ""
+}
+
+// relaxedHeader return field in relaxed canonical form (RFC 6376 3.4.2)
+func relaxedHeader(field string) string {
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return ""
+	}
+	name := strings.ToLower(strings.TrimSpace(field[:i]))
+	value := strings.NewReplacer("\r\n", "").Replace(field[i+1:])
+	value = strings.TrimSpace(collapseSpace(value))
+	return name + ":" + value + "\r\n"
+}
+
+// relaxedBody return body in relaxed canonical form (RFC 6376 3.4.4)
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(collapseSpace(line), " ")
+	}
+	// Empty lines at the end are ignored
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// collapseSpace replace runs of spaces and tabs with one space
+func collapseSpace(s string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(s[i])
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,304 @@
+package sendmail_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	msgauth "github.com/emersion/go-msgauth/dkim"
+	"github.com/n0madic/sendmail"
+)
+
+const dkimTestMessage = "From: Sender <sender@Example.com>\r\n" +
+	"To: user@example.org\r\n" +
+	"Subject:  Hello \r\n" +
+	"\tworld\r\n" +
+	"X-Unsigned: yes\r\n" +
+	"\r\n" +
+	"Hello  world \r\n" +
+	"\r\n" +
+	"\r\n"
+
+// dkimTags return tags of DKIM-Signature field and the signed data,
+// relaxed canonical form of the message is written out by hand.
+func dkimTags(t *testing.T, signed string) (map[string]string, []byte) {
+	t.Helper()
+	if !strings.HasPrefix(signed, "DKIM-Signature: ") {
+		t.Fatalf("Expected DKIM-Signature first, got: %s", signed)
+	}
+	end := strings.Index(signed, "\r\nFrom: ")
+	field := signed[:end]
+	for _, line := range strings.Split(field, "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("Expected line up to 78 characters, got %d: %s", len(line), line)
+		}
+	}
+	if signed[end+2:] != dkimTestMessage {
+		t.Errorf("Expected message unchanged after the signature, got: %s", signed[end+2:])
+	}
+
+	value := strings.Join(strings.Fields(strings.TrimPrefix(field, "DKIM-Signature:")), " ")
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		parts := strings.SplitN(strings.TrimSpace(tag), "=", 2)
+		tags[parts[0]] = strings.Replace(parts[1], " ", "", -1)
+	}
+	data := "from:Sender <sender@Example.com>\r\n" +
+		"subject:Hello world\r\n" +
+		"to:user@example.org\r\n" +
+		"dkim-signature:" + value[:strings.LastIndex(value, "b=")+2]
+	return tags, []byte(data)
+}
+
+func TestDKIMSignRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dkim := &sendmail.DKIM{
+		Keys:    map[string]*sendmail.DKIMKey{"example.com": {Selector: "mail", Signer: key}},
+		Headers: []string{"Subject", "To", "Cc"},
+	}
+	signed, err := dkim.Sign([]byte(dkimTestMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, data := dkimTags(t, string(signed))
+	expected := map[string]string{
+		"v": "1",
+		"a": "rsa-sha256",
+		"c": "relaxed/relaxed",
+		"d": "example.com",
+		"s": "mail",
+		"h": "from:subject:to",
+	}
+	for tag, value := range expected {
+		if tags[tag] != value {
+			t.Errorf("Expected %s=%s, got %q", tag, value, tags[tag])
+		}
+	}
+	bodyHash := sha256.Sum256([]byte("Hello world\r\n"))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		t.Error("Unexpected body hash", tags["bh"])
+	}
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(data)
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature); err != nil {
+		t.Error("Expected valid signature, got", err)
+	}
+}
+
+func TestDKIMSignEd25519(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dkim := &sendmail.DKIM{
+		Keys:    map[string]*sendmail.DKIMKey{"example.com": {Selector: "ed", Signer: private}},
+		Headers: []string{"Subject", "To"},
+	}
+	signed, err := dkim.Sign([]byte(dkimTestMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, data := dkimTags(t, string(signed))
+	if tags["a"] != "ed25519-sha256" {
+		t.Error("Expected a=ed25519-sha256, got", tags["a"])
+	}
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(data)
+	if !ed25519.Verify(public, hash[:], signature) {
+		t.Error("Expected valid signature")
+	}
+}
+
+func TestDKIMSignOtherDomain(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dkim := &sendmail.DKIM{
+		Keys: map[string]*sendmail.DKIMKey{"example.net": {Selector: "ed", Signer: private}},
+	}
+	signed, err := dkim.Sign([]byte(dkimTestMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(signed) != dkimTestMessage {
+		t.Errorf("Expected message unchanged, got: %s", signed)
+	}
+}
+
+func TestLoadDKIMKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dkim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{
+		"rsa.pem":     {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+		"ed25519.pem": {Type: "PRIVATE KEY", Bytes: pkcs8},
+	}
+	for name, block := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	signer, err := sendmail.LoadDKIMKey(filepath.Join(dir, "rsa.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := signer.(*rsa.PrivateKey); !ok {
+		t.Errorf("Expected *rsa.PrivateKey, got %T", signer)
+	}
+	signer, err = sendmail.LoadDKIMKey(filepath.Join(dir, "ed25519.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := signer.(ed25519.PrivateKey); !ok {
+		t.Errorf("Expected ed25519.PrivateKey, got %T", signer)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "bad.pem"), []byte("bad"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sendmail.LoadDKIMKey(filepath.Join(dir, "bad.pem")); err == nil {
+		t.Error("Expected error for file without PEM data")
+	}
+}
+
+func TestDKIMSignedOnce(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := sendmail.ParseTransportMap(strings.NewReader("local.test local\ndiscard.test discard\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.LocalDir = t.TempDir()
+	queue, err := sendmail.NewQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@example.com",
+		Recipients: []string{"user@local.test", "nobody@discard.test"},
+		Subject:    "test",
+		Body:       []byte("TEST"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.DKIM = &sendmail.DKIM{
+		Keys: map[string]*sendmail.DKIMKey{"example.com": {Selector: "ed", Signer: private}},
+	}
+	envelope.Transports = m
+	for result := range envelope.Send() {
+		if result.Level < sendmail.WarnLevel {
+			t.Error(result.Error)
+		}
+	}
+	mbox, err := ioutil.ReadFile(filepath.Join(m.LocalDir, "user"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(mbox), "DKIM-Signature:"); n != 1 {
+		t.Error("Expected one DKIM-Signature, got", n)
+	}
+
+	if _, err := queue.Accept(&envelope); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := queue.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !strings.HasPrefix(string(entries[0].Message), "DKIM-Signature: ") {
+		t.Error("Expected signed message in the queue, got", entries)
+	}
+}
+
+func TestDKIMSignLF(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dkim := &sendmail.DKIM{
+		Keys: map[string]*sendmail.DKIMKey{"example.com": {Selector: "ed", Signer: private}},
+	}
+	options := &msgauth.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			if domain != "ed._domainkey.example.com" {
+				return nil, fmt.Errorf("unexpected lookup of %s", domain)
+			}
+			return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(public)}, nil
+		},
+	}
+
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@example.com",
+		Recipients: []string{"user@example.org"},
+		Subject:    "test",
+		Body:       []byte("Hello\nworld\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := envelope.GenerateMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(message), "\r\n\r\nHello\r\nworld\r\n") {
+		t.Errorf("Expected body with CRLF line endings, got: %q", message)
+	}
+
+	for _, message := range [][]byte{
+		message,
+		[]byte("From: sender@example.com\nTo: user@example.org\nSubject: test\n\nHello\nworld\n"),
+	} {
+		signed, err := dkim.Sign(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifications, err := msgauth.VerifyWithOptions(bytes.NewReader(signed), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(verifications) != 1 || verifications[0].Err != nil {
+			t.Errorf("Expected valid signature, got %+v", verifications[0])
+		}
+	}
+}
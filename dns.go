@@ -0,0 +1,254 @@
+package sendmail
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultDNSTimeout of queries made by DNSResolver
+const DefaultDNSTimeout = 5 * time.Second
+
+// TLSA record (RFC 6698)
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	// Certificate association data
+	Data []byte
+}
+
+// TLSAResolver looks up TLSA records.
+type TLSAResolver interface {
+	// LookupTLSA return TLSA records of name, secure reports whether the
+	// answer was authenticated by a validating resolver (AD bit).
+	// A nonexistent name is not an error.
+	LookupTLSA(ctx context.Context, name string) (records []TLSA, secure bool, err error)
+}
+
+// DNSResolver sends queries directly to a DNS server.
+// It implements TTLResolver and TLSAResolver.
+// Authenticated data is only trustworthy from a validating
+// resolver over a secure channel, such as one on localhost.
+type DNSResolver struct {
+	// Server address host:port, the first nameserver of
+	// /etc/resolv.conf is used if empty
+	Server string
+	// Timeout of a query, DefaultDNSTimeout if zero
+	Timeout time.Duration
+}
+
+func (r *DNSResolver) server() string {
+	if r.Server != "" {
+		return r.Server
+	}
+	if config, err := dns.ClientConfigFromFile("/etc/resolv.conf"); err == nil && len(config.Servers) > 0 {
+		return net.JoinHostPort(config.Servers[0], config.Port)
+	}
+	return "127.0.0.1:53"
+}
+
+// exchange send query for name with the DNSSEC OK and AD bits set,
+// retrying over TCP if the answer is truncated.
+func (r *DNSResolver) exchange(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultDNSTimeout
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.SetEdns0(4096, true)
+	msg.AuthenticatedData = true
+
+	client := &dns.Client{Timeout: timeout}
+	resp, _, err := client.ExchangeContext(ctx, msg, r.server())
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, msg, r.server())
+	}
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name, Server: r.server(), IsTemporary: true}
+	}
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+		return resp, nil
+	case dns.RcodeNameError:
+		return resp, &net.DNSError{Err: "no such host", Name: name, Server: r.server(), IsNotFound: true}
+	default:
+		return nil, &net.DNSError{
+			Err:         fmt.Sprintf("server misbehaving: %s", dns.RcodeToString[resp.Rcode]),
+			Name:        name,
+			Server:      r.server(),
+			IsTemporary: true,
+		}
+	}
+}
+
+// LookupTLSA return TLSA records of name
+func (r *DNSResolver) LookupTLSA(ctx context.Context, name string) ([]TLSA, bool, error) {
+	resp, err := r.exchange(ctx, name, dns.TypeTLSA)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, resp.AuthenticatedData, nil
+		}
+		return nil, false, err
+	}
+	var records []TLSA
+	for _, rr := range resp.Answer {
+		tlsa, ok := rr.(*dns.TLSA)
+		if !ok {
+			continue
+		}
+		data, err := hex.DecodeString(tlsa.Certificate)
+		if err != nil {
+			continue
+		}
+		records = append(records, TLSA{
+			Usage:        tlsa.Usage,
+			Selector:     tlsa.Selector,
+			MatchingType: tlsa.MatchingType,
+			Data:         data,
+		})
+	}
+	return records, resp.AuthenticatedData, nil
+}
+
+// LookupMX return MX records of name sorted by preference
+func (r *DNSResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	records, _, err := r.LookupMXWithTTL(ctx, name)
+	return records, err
+}
+
+// LookupMXWithTTL return MX records of name sorted by preference
+func (r *DNSResolver) LookupMXWithTTL(ctx context.Context, name string) ([]*net.MX, time.Duration, error) {
+	resp, err := r.exchange(ctx, name, dns.TypeMX)
+	if err != nil {
+		return nil, negativeTTL(resp), err
+	}
+	var records []*net.MX
+	for _, rr := range resp.Answer {
+		if mx, ok := rr.(*dns.MX); ok {
+			records = append(records, &net.MX{Host: mx.Mx, Pref: mx.Preference})
+		}
+	}
+	if len(records) == 0 {
+		return nil, negativeTTL(resp), notFound(name)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Pref < records[j].Pref
+	})
+	return records, answerTTL(resp), nil
+}
+
+// LookupIP return IPv4 and IPv6 addresses of host
+func (r *DNSResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ips, _, err := r.LookupIPWithTTL(ctx, host)
+	return ips, err
+}
+
+// LookupIPWithTTL return IPv4 and IPv6 addresses of host
+func (r *DNSResolver) LookupIPWithTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	var ips []net.IP
+	var lastErr error
+	ttl, negative := time.Duration(-1), time.Duration(-1)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := r.exchange(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			negative = minTTL(negative, negativeTTL(resp))
+			continue
+		}
+		found := false
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ips, found = append(ips, rr.A), true
+			case *dns.AAAA:
+				ips, found = append(ips, rr.AAAA), true
+			}
+		}
+		if found {
+			ttl = minTTL(ttl, answerTTL(resp))
+		} else {
+			negative = minTTL(negative, negativeTTL(resp))
+		}
+	}
+	if len(ips) == 0 {
+		if negative < 0 {
+			negative = 0
+		}
+		if lastErr != nil {
+			return nil, negative, lastErr
+		}
+		return nil, negative, notFound(host)
+	}
+	return ips, ttl, nil
+}
+
+// LookupTXT return TXT records of name
+func (r *DNSResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, _, err := r.LookupTXTWithTTL(ctx, name)
+	return records, err
+}
+
+// LookupTXTWithTTL return TXT records of name
+func (r *DNSResolver) LookupTXTWithTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	resp, err := r.exchange(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, negativeTTL(resp), err
+	}
+	var records []string
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			records = append(records, strings.Join(txt.Txt, ""))
+		}
+	}
+	if len(records) == 0 {
+		return nil, negativeTTL(resp), notFound(name)
+	}
+	return records, answerTTL(resp), nil
+}
+
+// answerTTL return the lowest TTL of the answer records
+func answerTTL(resp *dns.Msg) time.Duration {
+	ttl := time.Duration(-1)
+	for _, rr := range resp.Answer {
+		ttl = minTTL(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+	}
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+// negativeTTL return how long a nonexistent answer may be cached,
+// the SOA minimum of the authority section (RFC 2308) or zero if unknown.
+func negativeTTL(resp *dns.Msg) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+	return 0
+}
+
+// minTTL return the lower of two TTLs, a negative one is unset
+func minTTL(a, b time.Duration) time.Duration {
+	if a < 0 || (b >= 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,213 @@
+package sendmail
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default lifetimes of CachingResolver entries
+const (
+	DefaultCacheTTL    = 5 * time.Minute
+	DefaultNegativeTTL = time.Minute
+	DefaultMaxCacheTTL = time.Hour
+)
+
+// TTLResolver is a Resolver which also reports how long answers may be
+// cached. For a nonexistent name the TTL is the negative caching time,
+// zero if unknown.
+type TTLResolver interface {
+	Resolver
+	LookupMXWithTTL(ctx context.Context, name string) ([]*net.MX, time.Duration, error)
+	LookupIPWithTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+	LookupTXTWithTTL(ctx context.Context, name string) ([]string, time.Duration, error)
+}
+
+// CacheStats of a CachingResolver
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+// HitRate return the share of lookups answered from the cache
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type cacheKey struct {
+	qtype string
+	name  string
+}
+
+type cacheEntry struct {
+	value   interface{}
+	err     error
+	expires time.Time
+}
+
+// CachingResolver caches answers of another resolver in memory,
+// respecting record TTLs if the resolver is a TTLResolver.
+// Nonexistent names are cached too, temporary failures are not.
+// It is safe for concurrent use and should be shared between envelopes.
+type CachingResolver struct {
+	// Resolver to query, DefaultResolver if nil
+	Resolver Resolver
+	// DefaultTTL of answers without a known TTL, DefaultCacheTTL if zero
+	DefaultTTL time.Duration
+	// NegativeTTL of nonexistent names without a known TTL,
+	// DefaultNegativeTTL if zero
+	NegativeTTL time.Duration
+	// MaxTTL caps the lifetime of entries, DefaultMaxCacheTTL if zero
+	MaxTTL time.Duration
+
+	mu        sync.Mutex
+	entries   map[cacheKey]*cacheEntry
+	nextSweep time.Time
+	hits      uint64
+	misses    uint64
+}
+
+// NewCachingResolver return cache of resolver answers
+func NewCachingResolver(resolver Resolver) *CachingResolver {
+	return &CachingResolver{Resolver: resolver}
+}
+
+// LookupMX return MX records of name
+func (c *CachingResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	value, err := c.lookup(ctx, "MX", name, func(r Resolver) (interface{}, time.Duration, error) {
+		if r, ok := r.(TTLResolver); ok {
+			return r.LookupMXWithTTL(ctx, name)
+		}
+		records, err := r.LookupMX(ctx, name)
+		return records, -1, err
+	})
+	records, _ := value.([]*net.MX)
+	return records, err
+}
+
+// LookupIP return IPv4 and IPv6 addresses of host
+func (c *CachingResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	value, err := c.lookup(ctx, "IP", host, func(r Resolver) (interface{}, time.Duration, error) {
+		if r, ok := r.(TTLResolver); ok {
+			return r.LookupIPWithTTL(ctx, host)
+		}
+		ips, err := r.LookupIP(ctx, host)
+		return ips, -1, err
+	})
+	ips, _ := value.([]net.IP)
+	return ips, err
+}
+
+// LookupTXT return TXT records of name
+func (c *CachingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	value, err := c.lookup(ctx, "TXT", name, func(r Resolver) (interface{}, time.Duration, error) {
+		if r, ok := r.(TTLResolver); ok {
+			return r.LookupTXTWithTTL(ctx, name)
+		}
+		records, err := r.LookupTXT(ctx, name)
+		return records, -1, err
+	})
+	records, _ := value.([]string)
+	return records, err
+}
+
+// Stats return cache hits, misses and the number of entries
+func (c *CachingResolver) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Hits: c.hits, Misses: c.misses, Entries: len(c.entries)}
+}
+
+// Flush remove all entries from the cache
+func (c *CachingResolver) Flush() {
+	c.mu.Lock()
+	c.entries = nil
+	c.mu.Unlock()
+}
+
+// lookup return cached answer for name or query the resolver.
+// A negative ttl returned by query means the TTL is unknown.
+func (c *CachingResolver) lookup(ctx context.Context, qtype, name string,
+	query func(Resolver) (interface{}, time.Duration, error)) (interface{}, error) {
+	key := cacheKey{qtype, strings.ToLower(strings.TrimSuffix(name, "."))}
+	now := time.Now()
+
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok && now.Before(entry.expires) {
+		c.hits++
+		c.mu.Unlock()
+		return entry.value, entry.err
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	resolver := c.Resolver
+	if resolver == nil {
+		resolver = DefaultResolver
+	}
+	value, ttl, err := query(resolver)
+
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		if ttl < 0 {
+			ttl = c.defaultTTL()
+		}
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		if ttl <= 0 {
+			ttl = c.negativeTTL()
+		}
+	default:
+		return value, err
+	}
+	if ttl > c.maxTTL() {
+		ttl = c.maxTTL()
+	}
+	if ttl == 0 {
+		return value, err
+	}
+
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[cacheKey]*cacheEntry)
+	}
+	if now.After(c.nextSweep) {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.nextSweep = now.Add(time.Minute)
+	}
+	c.entries[key] = &cacheEntry{value, err, now.Add(ttl)}
+	c.mu.Unlock()
+	return value, err
+}
+
+func (c *CachingResolver) defaultTTL() time.Duration {
+	if c.DefaultTTL > 0 {
+		return c.DefaultTTL
+	}
+	return DefaultCacheTTL
+}
+
+func (c *CachingResolver) negativeTTL() time.Duration {
+	if c.NegativeTTL > 0 {
+		return c.NegativeTTL
+	}
+	return DefaultNegativeTTL
+}
+
+func (c *CachingResolver) maxTTL() time.Duration {
+	if c.MaxTTL > 0 {
+		return c.MaxTTL
+	}
+	return DefaultMaxCacheTTL
+}
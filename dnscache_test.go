@@ -0,0 +1,72 @@
+package sendmail_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/n0madic/sendmail"
+)
+
+// countingResolver counts lookups passed to the underlying resolver
+type countingResolver struct {
+	sendmail.StaticResolver
+	lookups int
+}
+
+func (r *countingResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	r.lookups++
+	return r.StaticResolver.LookupMX(ctx, name)
+}
+
+func TestCachingResolver(t *testing.T) {
+	upstream := &countingResolver{StaticResolver: sendmail.StaticResolver{
+		MX: map[string][]*net.MX{"example.com": {{Host: "mx.example.com.", Pref: 10}}},
+	}}
+	cache := sendmail.NewCachingResolver(upstream)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		records, err := cache.LookupMX(ctx, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 {
+			t.Fatal("Unexpected records", records)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		_, err := cache.LookupMX(ctx, "example.org")
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			t.Fatal("Expected not found error, got", err)
+		}
+	}
+	if upstream.lookups != 2 {
+		t.Error("Expected 2 upstream lookups, got", upstream.lookups)
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 3 || stats.Misses != 2 || stats.Entries != 2 {
+		t.Error("Unexpected stats", stats)
+	}
+	if rate := stats.HitRate(); rate != 0.6 {
+		t.Error("Expected hit rate 0.6, got", rate)
+	}
+}
+
+func TestCachingResolverExpiry(t *testing.T) {
+	upstream := &countingResolver{StaticResolver: sendmail.StaticResolver{
+		MX: map[string][]*net.MX{"example.com": {{Host: "mx.example.com.", Pref: 10}}},
+	}}
+	cache := sendmail.NewCachingResolver(upstream)
+	cache.DefaultTTL = time.Millisecond
+	ctx := context.Background()
+
+	cache.LookupMX(ctx, "example.com")
+	time.Sleep(2 * time.Millisecond)
+	cache.LookupMX(ctx, "example.com")
+	if upstream.lookups != 2 {
+		t.Error("Expected expired entry to be looked up again, got", upstream.lookups, "lookups")
+	}
+}
@@ -0,0 +1,217 @@
+package sendmail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var enhancedCodeRe = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})\s+`)
+
+// FailedRecipient describes a recipient whose delivery failed,
+// as reported in a delivery status notification.
+type FailedRecipient struct {
+	Recipient string
+	// RemoteMTA is the host which rejected the message (optional)
+	RemoteMTA string
+	// Code is the SMTP reply code, zero if there was no SMTP reply
+	Code int
+	// Status is the enhanced status code (RFC 3463)
+	Status string
+	// Message is the SMTP reply text or the error description
+	Message string
+}
+
+// newFailedRecipient return failure of recipient from the delivery error.
+func newFailedRecipient(recipient, host string, err error) FailedRecipient {
+	failed := FailedRecipient{
+		Recipient: recipient,
+		RemoteMTA: host,
+		Status:    "5.0.0",
+		Message:   err.Error(),
+	}
+	var protoErr *textproto.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &protoErr):
+		failed.Code = protoErr.Code
+		failed.Status = fmt.Sprintf("%d.0.0", protoErr.Code/100)
+		failed.Message = protoErr.Msg
+		if match := enhancedCodeRe.FindStringSubmatch(protoErr.Msg); match != nil {
+			failed.Status = match[1]
+			failed.Message = strings.TrimPrefix(protoErr.Msg, match[0])
+		}
+	case errors.As(err, &dnsErr):
+		// Bad destination system address
+		failed.Status = "5.1.2"
+	}
+	return failed
+}
+
+// diagnostic return the Diagnostic-Code value or empty string
+// if the failure is not caused by an SMTP reply.
+func (f *FailedRecipient) diagnostic() string {
+	if f.Code == 0 {
+		return ""
+	}
+	return fmt.Sprintf("smtp; %d %s %s", f.Code, f.Status, f.Message)
+}
+
+// NewDSN return delivery status notification (RFC 3464) for message
+// which could not be delivered to the failed recipients.
+// The notification is addressed to sender and has the null envelope sender.
+func NewDSN(sender string, message []byte, failed []FailedRecipient) (Envelope, error) {
+	if sender == "" || sender == NullSender {
+		return Envelope{}, errors.New("null sender can't receive notifications")
+	}
+	if len(failed) == 0 {
+		return Envelope{}, errors.New("no failed recipients")
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	body := bytes.NewBuffer(nil)
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"text/plain; charset=utf-8"},
+		"Content-Description": {"Notification"},
+	})
+	if err != nil {
+		return Envelope{}, err
+	}
+	fmt.Fprintf(part, "This is the mail system at host %s.\r\n\r\n", hostname)
+	fmt.Fprint(part, "I'm sorry to have to inform you that your message could not\r\n")
+	fmt.Fprint(part, "be delivered to one or more recipients.\r\n\r\n")
+	for _, f := range failed {
+		if f.RemoteMTA != "" {
+			fmt.Fprintf(part, "<%s>: host %s said: %s\r\n", f.Recipient, f.RemoteMTA, f.Message)
+		} else {
+			fmt.Fprintf(part, "<%s>: %s\r\n", f.Recipient, f.Message)
+		}
+	}
+
+	part, err = writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"message/delivery-status"},
+		"Content-Description": {"Delivery report"},
+	})
+	if err != nil {
+		return Envelope{}, err
+	}
+	fmt.Fprintf(part, "Reporting-MTA: dns; %s\r\n", hostname)
+	fmt.Fprintf(part, "Arrival-Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	for _, f := range failed {
+		fmt.Fprint(part, "\r\n")
+		fmt.Fprintf(part, "Final-Recipient: rfc822; %s\r\n", f.Recipient)
+		fmt.Fprint(part, "Action: failed\r\n")
+		fmt.Fprintf(part, "Status: %s\r\n", f.Status)
+		if f.RemoteMTA != "" {
+			fmt.Fprintf(part, "Remote-MTA: dns; %s\r\n", f.RemoteMTA)
+		}
+		if diagnostic := f.diagnostic(); diagnostic != "" {
+			fmt.Fprintf(part, "Diagnostic-Code: %s\r\n", diagnostic)
+		}
+	}
+
+	part, err = writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"text/rfc822-headers"},
+		"Content-Description": {"Undelivered Message Headers"},
+	})
+	if err != nil {
+		return Envelope{}, err
+	}
+	headers := message
+	if i := bytes.Index(message, []byte("\r\n\r\n")); i >= 0 {
+		headers = message[:i+2]
+	}
+	part.Write(headers)
+
+	if err := writer.Close(); err != nil {
+		return Envelope{}, err
+	}
+
+	msg := &mail.Message{
+		Header: mail.Header{
+			"From":           {"Mail Delivery System <MAILER-DAEMON@" + hostname + ">"},
+			"To":             {"<" + sender + ">"},
+			"Subject":        {"Undelivered Mail Returned to Sender"},
+			"Date":           {time.Now().Format(time.RFC1123Z)},
+			"Message-ID":     {generateMessageID(hostname)},
+			"Auto-Submitted": {"auto-replied"},
+			"MIME-Version":   {"1.0"},
+			"Content-Type": {
+				"multipart/report; report-type=delivery-status; boundary=\"" + writer.Boundary() + "\"",
+			},
+		},
+		Body: body,
+	}
+	return Envelope{
+		Message:    msg,
+		Sender:     NullSender,
+		Recipients: []string{sender},
+		PortSMTP:   "25",
+	}, nil
+}
+
+// isDSN reports whether the message is a delivery status notification.
+func (e *Envelope) isDSN() bool {
+	contentType := strings.ToLower(e.Header.Get("Content-Type"))
+	return strings.HasPrefix(contentType, "multipart/report") &&
+		strings.Contains(contentType, "delivery-status")
+}
+
+// bounce deliver notification about failed recipients to the envelope sender
+// with the send function. Messages from the null sender and notifications
+// are never bounced.
+func (e *Envelope) bounce(message []byte, failed []FailedRecipient, send func(*Envelope) <-chan Result, results chan<- Result) {
+	sender := e.mailFrom()
+	fields := Fields{
+		"sender":     e.Header.Get("From"),
+		"recipients": strings.Join(failedRecipients(failed), ","),
+	}
+	if sender == "" || e.isDSN() {
+		results <- Result{WarnLevel, errors.New("bounce suppressed for null sender"), "Bounce", fields}
+		return
+	}
+	dsn, err := NewDSN(sender, message, failed)
+	if err != nil {
+		results <- Result{ErrorLevel, err, "Bounce", fields}
+		return
+	}
+	dsn.PortSMTP = e.PortSMTP
+	dsn.TLSPolicy = e.TLSPolicy
+	dsn.TLSConfig = e.TLSConfig
+	dsn.Resolver = e.Resolver
+	dsn.MTASTS = e.MTASTS
+	dsn.DANE = e.DANE
+	dsn.DKIM = e.DKIM
+	dsn.Transports = e.Transports
+	dsn.Relays = e.Relays
+	dsn.Queue = e.Queue
+	for result := range send(&dsn) {
+		if result.Level < WarnLevel {
+			result.Level = WarnLevel
+		}
+		if result.Message == "" {
+			result.Message = "Bounce"
+		}
+		results <- result
+	}
+}
+
+func failedRecipients(failed []FailedRecipient) (recipients []string) {
+	for _, f := range failed {
+		recipients = append(recipients, f.Recipient)
+	}
+	return
+}
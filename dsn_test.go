@@ -0,0 +1,113 @@
+package sendmail_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/test"
+)
+
+func TestNewDSN(t *testing.T) {
+	original := []byte("From: sender@localhost\r\nTo: user@example.com\r\nSubject: test\r\n\r\nTEST\r\n")
+	failed := []sendmail.FailedRecipient{{
+		Recipient: "user@example.com",
+		RemoteMTA: "mx.example.com",
+		Code:      550,
+		Status:    "5.1.1",
+		Message:   "User unknown",
+	}}
+
+	if _, err := sendmail.NewDSN(sendmail.NullSender, original, failed); err == nil {
+		t.Error("Expected error for null sender")
+	}
+
+	dsn, err := sendmail.NewDSN("sender@localhost", original, failed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dsn.Sender != sendmail.NullSender {
+		t.Error("Expected null sender, got", dsn.Sender)
+	}
+	if len(dsn.Recipients) != 1 || dsn.Recipients[0] != "sender@localhost" {
+		t.Error("Expected recipient sender@localhost, got", dsn.Recipients)
+	}
+
+	message, err := dsn.GenerateMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatal("Expected multipart/report, got", msg.Header.Get("Content-Type"))
+	}
+
+	expected := []struct {
+		contentType string
+		contains    []string
+	}{
+		{"text/plain; charset=utf-8", []string{"<user@example.com>: host mx.example.com said: User unknown"}},
+		{"message/delivery-status", []string{
+			"Final-Recipient: rfc822; user@example.com\r\n",
+			"Action: failed\r\n",
+			"Status: 5.1.1\r\n",
+			"Remote-MTA: dns; mx.example.com\r\n",
+			"Diagnostic-Code: smtp; 550 5.1.1 User unknown\r\n",
+		}},
+		{"text/rfc822-headers", []string{"Subject: test\r\n"}},
+	}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for _, exp := range expected {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.Header.Get("Content-Type") != exp.contentType {
+			t.Error("Expected", exp.contentType, "got", part.Header.Get("Content-Type"))
+		}
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, str := range exp.contains {
+			if !strings.Contains(string(content), str) {
+				t.Errorf("Expected %q in %s part, got: %s", str, exp.contentType, content)
+			}
+		}
+	}
+}
+
+func TestBounce(t *testing.T) {
+	go test.StartSMTP()
+	test.WaitSMTP()
+
+	config := testConfigs[0].initial
+	config.Recipients = []string{"unknown@localhost"}
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.Bounce = true
+
+	bounced := false
+	for result := range envelope.SendSmarthost("localhost:"+test.PortSMTP, "", "") {
+		if result.Level == sendmail.InfoLevel && result.Fields["recipient"] == "sender@localhost" {
+			bounced = true
+		}
+	}
+	if !bounced {
+		t.Error("Expected bounce to sender@localhost")
+	}
+}
@@ -3,6 +3,11 @@ module github.com/n0madic/sendmail
 go 1.16
 
 require (
+	github.com/emersion/go-msgauth v0.7.0
+	github.com/emersion/go-sasl v0.0.0-20241020182733-b788ff22d5a6
 	github.com/emersion/go-smtp v0.24.0
+	github.com/miekg/dns v1.1.50
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/crypto v0.31.0
+	gopkg.in/yaml.v3 v3.0.1
 )
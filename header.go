@@ -0,0 +1,144 @@
+package sendmail
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// maxHeaderLine is the line length recommended by RFC 5322
+const maxHeaderLine = 78
+
+// addressHeaders are fields with address lists, their display names
+// are encoded instead of the whole value
+var addressHeaders = map[string]bool{
+	"From":                        true,
+	"Sender":                      true,
+	"Reply-To":                    true,
+	"To":                          true,
+	"Cc":                          true,
+	"Bcc":                         true,
+	"Resent-From":                 true,
+	"Resent-Sender":               true,
+	"Resent-To":                   true,
+	"Resent-Cc":                   true,
+	"Resent-Bcc":                  true,
+	"Disposition-Notification-To": true,
+}
+
+// newlines are replaced in header values, a CR or LF would end the field
+// and let the value inject fields or the body
+var newlines = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// writeHeaderField write header field encoded by RFC 2047 and folded by RFC 5322
+func writeHeaderField(buf *bytes.Buffer, key, value string) {
+	value = newlines.Replace(value)
+	buf.WriteString(foldHeader(key + ": " + encodeHeader(key, value)))
+	buf.WriteString("\r\n")
+}
+
+// encodeHeader return value with non-ASCII text in encoded words,
+// ASCII values (already encoded as well) are returned untouched.
+func encodeHeader(key, value string) string {
+	if isASCII(value) {
+		return value
+	}
+	if addressHeaders[textproto.CanonicalMIMEHeaderKey(key)] {
+		if list, err := mail.ParseAddressList(value); err == nil {
+			addresses := make([]string, len(list))
+			for i, address := range list {
+				// Display names are encoded by String
+				addresses[i] = address.String()
+			}
+			return strings.Join(addresses, ", ")
+		}
+	}
+	return mime.BEncoding.Encode("utf-8", value)
+}
+
+// foldHeader return field with CRLF inserted before whitespace so that
+// lines do not exceed maxHeaderLine, a line without whitespace stays long.
+func foldHeader(field string) string {
+	var folded strings.Builder
+	for len(field) > maxHeaderLine {
+		// A fold right after the field name only if the first word is too long
+		start := strings.Index(field, ":") + 1
+		if folded.Len() > 0 {
+			start = 1
+		}
+		i := strings.LastIndexAny(field[:maxHeaderLine+1], " \t")
+		if i < start {
+			// Fold at the next whitespace for overlong words
+			next := strings.IndexAny(field[maxHeaderLine:], " \t")
+			if next < 0 {
+				break
+			}
+			i = maxHeaderLine + next
+		}
+		folded.WriteString(field[:i] + "\r\n")
+		field = field[i:]
+	}
+	folded.WriteString(field)
+	return folded.String()
+}
+
+// headerField is a field of the original message
+type headerField struct {
+	// key is the canonical name
+	key string
+	// raw is the field as received with folded lines, without the final CRLF
+	raw string
+	// value is the unfolded value as in mail.Header
+	value string
+}
+
+// headerFields return fields of the header of message in order,
+// line endings of raw fields are CRLF.
+func headerFields(message []byte) []headerField {
+	var fields []headerField
+	for len(message) > 0 {
+		line := message
+		if i := bytes.IndexByte(message, '\n'); i >= 0 {
+			line, message = message[:i], message[i+1:]
+		} else {
+			message = nil
+		}
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			break
+		}
+		// Continuation of a folded field
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(fields) > 0 {
+				fields[len(fields)-1].raw += "\r\n" + string(line)
+			}
+			continue
+		}
+		if i := bytes.IndexByte(line, ':'); i > 0 {
+			fields = append(fields, headerField{
+				key: textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(string(line[:i]))),
+				raw: string(line),
+			})
+		}
+	}
+	for i := range fields {
+		// Parsed alone the value is the same as in the whole header
+		reader := textproto.NewReader(bufio.NewReader(strings.NewReader(fields[i].raw + "\r\n\r\n")))
+		if header, err := reader.ReadMIMEHeader(); err == nil {
+			fields[i].value = header.Get(fields[i].key)
+		}
+	}
+	return fields
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
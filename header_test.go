@@ -0,0 +1,183 @@
+package sendmail_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+)
+
+func TestGenerateMessageEncoding(t *testing.T) {
+	subject := "Отчёт о доставке почты за прошедший месяц, включая все вложения и примечания"
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "Иван Петров <ivan@example.com>",
+		Recipients: []string{"user@example.com"},
+		Subject:    subject,
+		Body:       []byte("TEST"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.Header["References"] = []string{strings.Repeat("<0123456789abcdef@example.com> ", 5)}
+	message, err := envelope.GenerateMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := message[:bytes.Index(message, []byte("\r\n\r\n"))]
+	for _, line := range strings.Split(string(header), "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("Expected line up to 78 characters, got %d: %s", len(line), line)
+		}
+		for _, c := range []byte(line) {
+			if c >= 0x80 {
+				t.Error("Expected ASCII header, got", line)
+				break
+			}
+		}
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != subject {
+		t.Errorf("Expected subject %q, got %q", subject, decoded)
+	}
+	from, err := msg.Header.AddressList("From")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(from) != 1 || from[0].Name != "Иван Петров" || from[0].Address != "ivan@example.com" {
+		t.Error("Expected From Иван Петров <ivan@example.com>, got", from)
+	}
+}
+
+func TestGenerateMessageEncoded(t *testing.T) {
+	subject := "=?UTF-8?B?0J/RgNC40LLQtdGC?="
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@localhost",
+		Recipients: []string{"user@example.com"},
+		Subject:    subject,
+		Body:       []byte("TEST"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := envelope.GenerateMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(message, []byte("\r\nSubject: "+subject+"\r\n")) {
+		t.Errorf("Expected encoded subject untouched, got: %s", message)
+	}
+}
+
+func TestGenerateMessageInjection(t *testing.T) {
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@localhost",
+		Recipients: []string{"user@example.com"},
+		Subject:    "hi\r\nBcc: spy@evil.test\r\n\r\ninjected body",
+		Body:       []byte("TEST"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.Header["X-Test"] = []string{"a\nb\rc"}
+	message, err := envelope.GenerateMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcc := msg.Header.Get("Bcc"); bcc != "" {
+		t.Error("Expected no Bcc header, got", bcc)
+	}
+	if subject := msg.Header.Get("Subject"); subject != "hi Bcc: spy@evil.test  injected body" {
+		t.Errorf("Expected subject on one line, got %q", subject)
+	}
+	if value := msg.Header.Get("X-Test"); value != "a b c" {
+		t.Errorf("Expected X-Test on one line, got %q", value)
+	}
+	body, _ := ioutil.ReadAll(msg.Body)
+	if string(body) != "TEST\r\n" {
+		t.Errorf("Expected body TEST, got %q", body)
+	}
+}
+
+func TestGenerateMessageOrder(t *testing.T) {
+	body := "Received: from b by c\r\n" +
+		"Received: from a by b\r\n" +
+		"DKIM-Signature: v=1; d=example.com;\r\n" +
+		"  b=abc\r\n" +
+		"From: sender@example.com\r\n" +
+		"Comments: first\r\n" +
+		"To: user@example.com\r\n" +
+		"X-Mixed-CASE:  folded\r\n" +
+		"\tvalue\r\n" +
+		"Comments: second\r\n" +
+		"SUBJECT: test\r\n" +
+		"\r\n" +
+		"TEST\r\n"
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Recipients: []string{"user@example.com"},
+		Subject:    "changed",
+		Body:       []byte(body),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.Header["Received"] = append([]string{"from c by d"}, envelope.Header["Received"]...)
+	message, err := envelope.GenerateMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := string(message[:bytes.Index(message, []byte("\r\n\r\n"))])
+	lines := strings.Split(header, "\r\n")
+	expected := []string{
+		"Message-ID: " + envelope.Header["Message-ID"][0],
+		"Received: from c by d",
+		"Received: from b by c",
+		"Received: from a by b",
+		"DKIM-Signature: v=1; d=example.com;",
+		"  b=abc",
+		"From: sender@example.com",
+		"Comments: first",
+		"To: user@example.com",
+		"X-Mixed-CASE:  folded",
+		"\tvalue",
+		"Comments: second",
+		"SUBJECT: changed",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected header %q, got %q", expected, lines)
+	}
+}
+
+func TestGenerateMessageLF(t *testing.T) {
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Recipients: []string{"user@example.com"},
+		Body:       []byte("From: sender@example.com\nReferences: <a@example.com>\n <b@example.com>\n\nTEST\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := envelope.GenerateMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(message, []byte("\r\nReferences: <a@example.com>\r\n <b@example.com>\r\n")) {
+		t.Errorf("Expected folded field with CRLF, got %q", message)
+	}
+}
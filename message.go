@@ -0,0 +1,210 @@
+package sendmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Message is a builder of MIME message bodies with a plain text and
+// an HTML alternative, attachments and inline images.
+type Message struct {
+	// Text is the plain text part
+	Text string
+	// HTML is the HTML part, the alternative of Text if both are set
+	HTML string
+
+	attachments []attachment
+	inline      []attachment
+}
+
+type attachment struct {
+	filename    string
+	contentType string
+	contentID   string
+	data        []byte
+}
+
+// entity is a MIME header with the encoded body
+type entity struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// Attach add file read from r, the content type is detected
+// by the filename extension if empty.
+func (m *Message) Attach(filename, contentType string, r io.Reader) error {
+	a, err := newAttachment(filename, contentType, r)
+	if err != nil {
+		return err
+	}
+	m.attachments = append(m.attachments, a)
+	return nil
+}
+
+// Inline add image read from r which HTML refers to as "cid:" + contentID.
+func (m *Message) Inline(contentID, filename, contentType string, r io.Reader) error {
+	if contentID == "" {
+		return errors.New("empty content ID")
+	}
+	a, err := newAttachment(filename, contentType, r)
+	if err != nil {
+		return err
+	}
+	a.contentID = strings.Trim(contentID, "<>")
+	m.inline = append(m.inline, a)
+	return nil
+}
+
+func newAttachment(filename, contentType string, r io.Reader) (attachment, error) {
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(filename))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return attachment{}, err
+	}
+	return attachment{filename: filename, contentType: contentType, data: data}, nil
+}
+
+// Bytes return MIME headers and body of the message, without the
+// addressing headers which are added by NewEnvelope.
+//
+// The structure is multipart/mixed of the attachments and
+// multipart/related of the HTML and inline images, which contains
+// multipart/alternative of the text and the HTML. Needless levels are omitted.
+func (m *Message) Bytes() ([]byte, error) {
+	var content []entity
+	if m.Text != "" || m.HTML == "" {
+		content = append(content, textEntity("text/plain", m.Text))
+	}
+	if m.HTML != "" {
+		content = append(content, textEntity("text/html", m.HTML))
+	}
+	root := content[0]
+	var err error
+	if len(content) > 1 {
+		if root, err = multipartEntity("alternative", content); err != nil {
+			return nil, err
+		}
+	}
+
+	var files []entity
+	if m.HTML != "" && len(m.inline) > 0 {
+		related := []entity{root}
+		for _, a := range m.inline {
+			related = append(related, a.entity("inline"))
+		}
+		if root, err = multipartEntity("related", related); err != nil {
+			return nil, err
+		}
+	} else {
+		// Nothing refers to the images without HTML
+		for _, a := range m.inline {
+			files = append(files, a.entity("inline"))
+		}
+	}
+	for _, a := range m.attachments {
+		files = append(files, a.entity("attachment"))
+	}
+	if len(files) > 0 {
+		if root, err = multipartEntity("mixed", append([]entity{root}, files...)); err != nil {
+			return nil, err
+		}
+	}
+
+	root.header.Set("MIME-Version", "1.0")
+	buf := bytes.NewBuffer(nil)
+	writeHeader(buf, root.header)
+	buf.WriteString("\r\n")
+	buf.Write(root.body)
+	return buf.Bytes(), nil
+}
+
+// textEntity return UTF-8 text in quoted-printable encoding
+func textEntity(contentType, text string) entity {
+	buf := bytes.NewBuffer(nil)
+	w := quotedprintable.NewWriter(buf)
+	w.Write([]byte(text))
+	w.Close()
+	return entity{
+		header: textproto.MIMEHeader{
+			"Content-Type":              {contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		},
+		body: buf.Bytes(),
+	}
+}
+
+// entity return attachment in base64 encoding with the given disposition
+func (a *attachment) entity(disposition string) entity {
+	header := textproto.MIMEHeader{
+		"Content-Type":              {a.contentType},
+		"Content-Transfer-Encoding": {"base64"},
+	}
+	if a.filename != "" {
+		header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.filename}))
+	} else {
+		header.Set("Content-Disposition", disposition)
+	}
+	if a.contentID != "" {
+		header.Set("Content-ID", "<"+a.contentID+">")
+	}
+	encoded := base64.StdEncoding.EncodeToString(a.data)
+	buf := bytes.NewBuffer(nil)
+	// Lines are limited to 76 characters (RFC 2045)
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+	return entity{header: header, body: buf.Bytes()}
+}
+
+// multipartEntity return multipart of the given subtype
+func multipartEntity(subtype string, parts []entity) (entity, error) {
+	buf := bytes.NewBuffer(nil)
+	writer := multipart.NewWriter(buf)
+	for _, part := range parts {
+		w, err := writer.CreatePart(part.header)
+		if err != nil {
+			return entity{}, err
+		}
+		w.Write(part.body)
+	}
+	if err := writer.Close(); err != nil {
+		return entity{}, err
+	}
+	return entity{
+		header: textproto.MIMEHeader{
+			"Content-Type": {"multipart/" + subtype + "; boundary=\"" + writer.Boundary() + "\""},
+		},
+		body: buf.Bytes(),
+	}, nil
+}
+
+// writeHeader write header fields sorted by name
+func writeHeader(buf *bytes.Buffer, header textproto.MIMEHeader) {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range header[key] {
+			writeHeaderField(buf, key, value)
+		}
+	}
+}
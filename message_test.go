@@ -0,0 +1,149 @@
+package sendmail_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+)
+
+type testPart struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// readParts return parts of multipart body with the expected media type
+func readParts(t *testing.T, contentType string, body io.Reader, expected string) []testPart {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != expected {
+		t.Fatalf("Expected %s, got %s", expected, mediaType)
+	}
+	var parts []testPart
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, testPart{part.Header, data})
+	}
+	return parts
+}
+
+func TestMessage(t *testing.T) {
+	message := &sendmail.Message{
+		Text: "Hello, world",
+		HTML: `<p>Hello, <img src="cid:logo"></p>`,
+	}
+	pdf := bytes.Repeat([]byte("%PDF-1.4 binary \x00\xff"), 20)
+	if err := message.Attach("report.pdf", "", bytes.NewReader(pdf)); err != nil {
+		t.Fatal(err)
+	}
+	if err := message.Inline("logo", "logo.png", "image/png", strings.NewReader("PNG")); err != nil {
+		t.Fatal(err)
+	}
+	if err := message.Inline("", "logo.png", "image/png", strings.NewReader("PNG")); err == nil {
+		t.Error("Expected error for empty content ID")
+	}
+
+	envelope, err := sendmail.NewEnvelope(&sendmail.Config{
+		Sender:     "sender@localhost",
+		Recipients: []string{"user@example.com"},
+		Subject:    "test",
+		Message:    message,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := envelope.GenerateMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(generated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("To") != "user@example.com" {
+		t.Error("Expected To header user@example.com, got", msg.Header.Get("To"))
+	}
+	if msg.Header.Get("MIME-Version") != "1.0" {
+		t.Error("Expected MIME-Version 1.0, got", msg.Header.Get("MIME-Version"))
+	}
+
+	mixed := readParts(t, msg.Header.Get("Content-Type"), msg.Body, "multipart/mixed")
+	if len(mixed) != 2 {
+		t.Fatal("Expected 2 parts of multipart/mixed, got", len(mixed))
+	}
+	related := readParts(t, mixed[0].header.Get("Content-Type"), bytes.NewReader(mixed[0].body), "multipart/related")
+	if len(related) != 2 {
+		t.Fatal("Expected 2 parts of multipart/related, got", len(related))
+	}
+	if related[1].header.Get("Content-ID") != "<logo>" {
+		t.Error("Expected Content-ID <logo>, got", related[1].header.Get("Content-ID"))
+	}
+	alternative := readParts(t, related[0].header.Get("Content-Type"), bytes.NewReader(related[0].body), "multipart/alternative")
+	if len(alternative) != 2 {
+		t.Fatal("Expected 2 parts of multipart/alternative, got", len(alternative))
+	}
+	for i, expected := range []string{message.Text, message.HTML} {
+		text, err := ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(alternative[i].body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(text) != expected {
+			t.Errorf("Expected part %q, got %q", expected, text)
+		}
+	}
+
+	file := mixed[1]
+	if file.header.Get("Content-Type") != "application/pdf" {
+		t.Error("Expected application/pdf, got", file.header.Get("Content-Type"))
+	}
+	if _, params, _ := mime.ParseMediaType(file.header.Get("Content-Disposition")); params["filename"] != "report.pdf" {
+		t.Error("Expected filename report.pdf, got", params["filename"])
+	}
+	data, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(file.body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, pdf) {
+		t.Error("Attachment is corrupted")
+	}
+}
+
+func TestMessageText(t *testing.T) {
+	body, err := (&sendmail.Message{Text: "Hello"}).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType := msg.Header.Get("Content-Type"); contentType != "text/plain; charset=utf-8" {
+		t.Error("Expected text/plain, got", contentType)
+	}
+	if encoding := msg.Header.Get("Content-Transfer-Encoding"); encoding != "quoted-printable" {
+		t.Error("Expected quoted-printable, got", encoding)
+	}
+}
@@ -1,101 +1,204 @@
 package sendmail
 
 import (
+	"context"
 	"errors"
 	"net"
-	"net/smtp"
+	"net/textproto"
 	"strings"
-	"sync/atomic"
+	"sync"
 )
 
 // SendLikeMTA message delivery directly, like Mail Transfer Agent.
+// If the envelope has a Queue, recipients that failed with a temporary
+// error are spooled there for a later retry.
 func (e *Envelope) SendLikeMTA() <-chan Result {
-	var successCount = new(int32)
+	return e.send((*Envelope).deliverMTA, (*Envelope).SendLikeMTA)
+}
+
+// mxHost of recipient domain
+type mxHost struct {
+	// name of the host
+	name string
+	// addr to connect
+	addr string
+}
+
+// deliverMTA sends generatedBody to the MX hosts of every recipient domain,
+// reporting a result per recipient. It blocks until all domains are processed.
+func (e *Envelope) deliverMTA(generatedBody []byte, results chan<- Result) deliveryReport {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		report deliveryReport
+	)
 	mapDomains := make(map[string][]string)
-	results := make(chan Result, len(e.Recipients))
-	generatedBody, err := e.GenerateMessage()
-	if err != nil {
-		results <- Result{FatalLevel, err, "Generate message", nil}
-	} else {
-		for _, recipient := range e.Recipients {
-			domain := GetDomainFromAddress(recipient)
-			mapDomains[domain] = append(mapDomains[domain], recipient)
-		}
+	for _, recipient := range e.Recipients {
+		domain := GetDomainFromAddress(recipient)
+		mapDomains[domain] = append(mapDomains[domain], recipient)
+	}
 
-		for domain, addresses := range mapDomains {
+	for domain, addresses := range mapDomains {
+		wg.Add(1)
+		go func(domain string, addresses []string) {
+			defer wg.Done()
+			var (
+				delivered int
+				failed    []FailedRecipient
+				// recipients still waiting for delivery
+				pending = addresses
+			)
+			defer func() {
+				mu.Lock()
+				defer mu.Unlock()
+				report.success += delivered
+				report.failed = append(report.failed, failed...)
+				report.deferred = append(report.deferred, pending...)
+			}()
 			rcpts := strings.Join(addresses, ",")
-			wg.Add(1)
-			go func(domain string, addresses []string) {
-				defer wg.Done()
-				var hostList []string
-				mxrecords, err := net.LookupMX(domain)
+			var hostList []mxHost
+			ctx := context.Background()
+			mxrecords, err := e.resolver().LookupMX(ctx, domain)
+			if err != nil {
+				results <- Result{WarnLevel, err, "LookupMX", Fields{
+					"sender":     e.Header.Get("From"),
+					"domain":     domain,
+					"recipients": rcpts,
+				}}
+				// Fallback to A records
+				ips, err := e.resolver().LookupIP(ctx, domain)
 				if err != nil {
-					results <- Result{WarnLevel, err, "LookupMX", Fields{
+					results <- Result{WarnLevel, err, "LookupIP", Fields{
 						"sender":     e.Header.Get("From"),
 						"domain":     domain,
 						"recipients": rcpts,
 					}}
-					// Fallback to A records
-					ips, err := net.LookupIP(domain)
+					if !isTemporary(err) {
+						for _, address := range pending {
+							failed = append(failed, newFailedRecipient(address, "", err))
+						}
+						pending = nil
+					}
+				} else {
+					// The domain itself is the implicit MX host
+					for _, ip := range ips {
+						hostList = append(hostList, mxHost{domain, ip.String()})
+					}
+				}
+			} else {
+				for _, mx := range mxrecords {
+					host := strings.TrimSuffix(mx.Host, ".")
+					ips, err := e.resolver().LookupIP(ctx, host)
 					if err != nil {
 						results <- Result{WarnLevel, err, "LookupIP", Fields{
 							"sender":     e.Header.Get("From"),
-							"domain":     domain,
+							"mx":         host,
 							"recipients": rcpts,
 						}}
-					} else {
-						for _, ip := range ips {
-							host := strings.TrimSuffix(ip.String(), ".")
-							hostList = append(hostList, host)
-						}
+						continue
 					}
-				} else {
-					for _, mx := range mxrecords {
-						host := strings.TrimSuffix(mx.Host, ".")
-						hostList = append(hostList, host)
+					for _, ip := range ips {
+						hostList = append(hostList, mxHost{host, ip.String()})
 					}
 				}
+			}
+			if len(hostList) == 0 {
+				results <- Result{WarnLevel, errors.New("MX not found"), "Lookup", Fields{
+					"sender":     e.Header.Get("From"),
+					"domain":     domain,
+					"recipients": rcpts,
+				}}
+				return
+			}
+			tlsPolicy := e.TLSPolicy
+			if e.MTASTS != nil {
+				hostList, tlsPolicy = e.applyMTASTS(domain, hostList, Fields{
+					"sender":     e.Header.Get("From"),
+					"domain":     domain,
+					"recipients": rcpts,
+				}, results)
 				if len(hostList) == 0 {
-					results <- Result{ErrorLevel, errors.New("MX not found"), "Lookup", Fields{
+					results <- Result{WarnLevel, errors.New("no MX host allowed by MTA-STS policy"), "MTA-STS", Fields{
 						"sender":     e.Header.Get("From"),
 						"domain":     domain,
 						"recipients": rcpts,
 					}}
-				} else {
-					for _, host := range hostList {
-						fields := Fields{
-							"sender":     e.Header.Get("From"),
-							"mx":         host,
-							"recipients": rcpts,
-						}
-						err := smtp.SendMail(host+":"+e.PortSMTP, nil,
-							e.Header.Get("From"),
-							addresses,
-							generatedBody)
-						if err == nil {
-							results <- Result{InfoLevel, nil, "Send mail OK", fields}
-							atomic.AddInt32(successCount, 1)
-							return
-						}
-						results <- Result{WarnLevel, err, "", fields}
+					return
+				}
+			}
+			for _, host := range hostList {
+				fields := Fields{
+					"sender": e.Header.Get("From"),
+					"mx":     host.name,
+				}
+				if host.addr != host.name {
+					fields["ip"] = host.addr
+				}
+				server := smtpServer{
+					addr:      net.JoinHostPort(host.addr, e.PortSMTP),
+					name:      host.name,
+					policy:    tlsPolicy,
+					tlsConfig: e.tlsConfig(host.name),
+				}
+				dane := false
+				if e.DANE != nil {
+					records, err := e.lookupDANE(host.name)
+					if err != nil {
+						// The TLSA records can't be trusted, skip this MX host
+						results <- Result{WarnLevel, err, "DANE", fields}
+						continue
 					}
+					if len(records) > 0 {
+						server.policy = TLSRequire
+						server.tlsConfig = daneConfig(host.name, records)
+						dane = true
+					}
+				}
+				statuses, tlsInfo := e.sendTo(server, pending, generatedBody)
+				if dane && tlsInfo != nil {
+					tlsInfo["dane"] = true
 				}
-			}(domain, addresses)
-		}
+				var retry []string
+				for _, address := range pending {
+					err := statuses[address]
+					rcptFields := Fields{"recipient": address}
+					for k, v := range fields {
+						rcptFields[k] = v
+					}
+					results <- recipientResult(err, rcptFields, tlsInfo)
+					switch {
+					case err == nil:
+						delivered++
+					case isTemporary(err):
+						// Try the next MX host
+						retry = append(retry, address)
+					default:
+						failed = append(failed, newFailedRecipient(address, host.name, err))
+					}
+				}
+				pending = retry
+				if len(pending) == 0 {
+					return
+				}
+			}
+		}(domain, addresses)
+	}
+	wg.Wait()
+	report.total = len(e.Recipients)
+	return report
+}
+
+// isTemporary reports whether a delivery error is worth a retry later.
+// SMTP 4xx replies, network failures and DNS timeouts are temporary,
+// SMTP 5xx replies and nonexistent domains are permanent.
+func isTemporary(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code/100 != 5
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
 	}
-	go func() {
-		wg.Wait()
-		fields := Fields{
-			"sender":  e.Header.Get("From"),
-			"success": *successCount,
-			"total":   int32(len(mapDomains)),
-		}
-		if *successCount == 0 {
-			results <- Result{ErrorLevel, errors.New("failed to deliver to all recipients"), "", fields}
-		} else if *successCount != int32(len(mapDomains)) {
-			results <- Result{ErrorLevel, errors.New("failed to deliver to some recipients"), "", fields}
-		}
-		close(results)
-	}()
-	return results
+	return true
 }
@@ -24,3 +24,41 @@ func TestSendLikeMTA(t *testing.T) {
 		}
 	}
 }
+
+func TestSendLikeMTAPerRecipient(t *testing.T) {
+	go test.StartSMTP()
+	test.WaitSMTP()
+
+	config := testConfigs[0].initial
+	config.Recipients = []string{"recipient@localhost", "unknown@localhost"}
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var delivered, rejected bool
+	for result := range envelope.SendLikeMTA() {
+		switch result.Fields["recipient"] {
+		case "recipient@localhost":
+			if result.Level == sendmail.InfoLevel {
+				delivered = true
+			}
+		case "unknown@localhost":
+			if result.Fields["code"] == 550 {
+				rejected = true
+				if result.Fields["enhanced_code"] != "5.1.1" {
+					t.Error("Expected enhanced code 5.1.1, got", result.Fields["enhanced_code"])
+				}
+			}
+		}
+		if result.Level < sendmail.WarnLevel && result.Error.Error() != "failed to deliver to some recipients" {
+			t.Error(result.Error)
+		}
+	}
+	if !delivered {
+		t.Error("Expected delivery to recipient@localhost")
+	}
+	if !rejected {
+		t.Error("Expected rejection of unknown@localhost")
+	}
+}
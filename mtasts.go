@@ -0,0 +1,285 @@
+package sendmail
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MTA-STS policy modes
+const (
+	MTASTSModeEnforce = "enforce"
+	MTASTSModeTesting = "testing"
+	MTASTSModeNone    = "none"
+)
+
+// maximum policy size and max_age allowed by RFC 8461
+const (
+	mtastsMaxPolicySize = 64 * 1024
+	mtastsMaxAge        = 31557600
+)
+
+var mtastsIDRe = regexp.MustCompile(`^[a-zA-Z0-9]{1,32}$`)
+
+// errMTASTSViolation is reported for MX hosts not allowed by the policy
+var errMTASTSViolation = errors.New("MX host is not allowed by MTA-STS policy")
+
+// MTASTSPolicy of a recipient domain (RFC 8461)
+type MTASTSPolicy struct {
+	ID     string
+	Mode   string
+	MX     []string
+	MaxAge time.Duration
+}
+
+// Match reports whether the MX host is allowed by the policy.
+// A pattern "*.example.com" matches exactly one leftmost label.
+func (p *MTASTSPolicy) Match(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if strings.HasPrefix(pattern, "*.") {
+			if i := strings.IndexByte(host, '.'); i > 0 && host[i+1:] == pattern[2:] {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseMTASTSPolicy parse policy file body
+func ParseMTASTSPolicy(body []byte) (*MTASTSPolicy, error) {
+	policy := &MTASTSPolicy{}
+	var version string
+	maxAge := -1
+	scanner := bufio.NewScanner(strings.NewReader(string(body)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid MTA-STS policy line %q", line)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch key {
+		case "version":
+			version = value
+		case "mode":
+			policy.Mode = value
+		case "mx":
+			policy.MX = append(policy.MX, value)
+		case "max_age":
+			age, err := strconv.Atoi(value)
+			if err != nil || age < 0 || age > mtastsMaxAge {
+				return nil, fmt.Errorf("invalid MTA-STS max_age %q", value)
+			}
+			maxAge = age
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if version != "STSv1" {
+		return nil, fmt.Errorf("unsupported MTA-STS version %q", version)
+	}
+	switch policy.Mode {
+	case MTASTSModeEnforce, MTASTSModeTesting:
+		if len(policy.MX) == 0 {
+			return nil, errors.New("MTA-STS policy without mx")
+		}
+	case MTASTSModeNone:
+	default:
+		return nil, fmt.Errorf("invalid MTA-STS mode %q", policy.Mode)
+	}
+	if maxAge < 0 {
+		return nil, errors.New("MTA-STS policy without max_age")
+	}
+	policy.MaxAge = time.Duration(maxAge) * time.Second
+	return policy, nil
+}
+
+type cachedMTASTSPolicy struct {
+	*MTASTSPolicy
+	expires time.Time
+}
+
+// MTASTS looks up, fetches and caches MTA-STS policies.
+// It is safe for concurrent use and should be shared between envelopes.
+type MTASTS struct {
+	// Resolver of the _mta-sts TXT record, DefaultResolver if nil
+	Resolver Resolver
+	// HTTPClient fetches policies over HTTPS (optional),
+	// redirects are not followed by the default client
+	HTTPClient *http.Client
+	// Timeout of the policy discovery, one minute if zero
+	Timeout time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*cachedMTASTSPolicy
+}
+
+// Policy return the MTA-STS policy of domain or nil if the domain has no policy.
+// A valid cached policy is returned when the discovery fails.
+func (m *MTASTS) Policy(domain string) (*MTASTSPolicy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	m.mu.Lock()
+	cached := m.cache[domain]
+	m.mu.Unlock()
+	if cached != nil && time.Now().After(cached.expires) {
+		cached = nil
+	}
+
+	id, err := m.lookupID(ctx, domain)
+	if err != nil {
+		if cached != nil {
+			return cached.MTASTSPolicy, nil
+		}
+		return nil, err
+	}
+	if id == "" {
+		if cached != nil {
+			return cached.MTASTSPolicy, nil
+		}
+		return nil, nil
+	}
+	if cached != nil && cached.ID == id {
+		return cached.MTASTSPolicy, nil
+	}
+
+	policy, err := m.fetch(ctx, domain)
+	if err != nil {
+		if cached != nil {
+			return cached.MTASTSPolicy, nil
+		}
+		return nil, err
+	}
+	policy.ID = id
+	m.mu.Lock()
+	if m.cache == nil {
+		m.cache = make(map[string]*cachedMTASTSPolicy)
+	}
+	m.cache[domain] = &cachedMTASTSPolicy{policy, time.Now().Add(policy.MaxAge)}
+	m.mu.Unlock()
+	return policy, nil
+}
+
+// lookupID return policy id from the _mta-sts TXT record,
+// empty if there is no record.
+func (m *MTASTS) lookupID(ctx context.Context, domain string) (string, error) {
+	resolver := m.Resolver
+	if resolver == nil {
+		resolver = DefaultResolver
+	}
+	records, err := resolver.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	var ids []string
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v=STSv1") {
+			continue
+		}
+		for _, field := range strings.Split(record, ";") {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "id=") {
+				ids = append(ids, strings.TrimPrefix(field, "id="))
+			}
+		}
+	}
+	// Several records are treated as no policy
+	if len(ids) != 1 {
+		return "", nil
+	}
+	if !mtastsIDRe.MatchString(ids[0]) {
+		return "", fmt.Errorf("invalid MTA-STS id %q", ids[0])
+	}
+	return ids[0], nil
+}
+
+func (m *MTASTS) fetch(ctx context.Context, domain string) (*MTASTSPolicy, error) {
+	client := m.HTTPClient
+	if client == nil {
+		client = &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+	url := "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("MTA-STS policy fetch %s: %s", url, resp.Status)
+	}
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err != nil || mediaType != "text/plain" {
+		return nil, fmt.Errorf("MTA-STS policy fetch %s: unexpected content type %q", url, resp.Header.Get("Content-Type"))
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, mtastsMaxPolicySize))
+	if err != nil {
+		return nil, err
+	}
+	return ParseMTASTSPolicy(body)
+}
+
+// applyMTASTS check MX hosts of domain against its MTA-STS policy,
+// reporting violations to results. In enforce mode it returns only the
+// allowed hosts and requires validated TLS.
+func (e *Envelope) applyMTASTS(domain string, hostList []mxHost, fields Fields, results chan<- Result) ([]mxHost, TLSPolicy) {
+	policy, err := e.MTASTS.Policy(domain)
+	if err != nil {
+		results <- Result{WarnLevel, err, "MTA-STS", fields}
+		return hostList, e.TLSPolicy
+	}
+	if policy == nil || policy.Mode == MTASTSModeNone {
+		return hostList, e.TLSPolicy
+	}
+	var allowed []mxHost
+	for _, host := range hostList {
+		if policy.Match(host.name) {
+			allowed = append(allowed, host)
+			continue
+		}
+		violation := Fields{"mx": host.name, "mode": policy.Mode}
+		for k, v := range fields {
+			violation[k] = v
+		}
+		results <- Result{WarnLevel, errMTASTSViolation, "MTA-STS", violation}
+	}
+	if policy.Mode != MTASTSModeEnforce {
+		return hostList, e.TLSPolicy
+	}
+	return allowed, TLSRequire
+}
@@ -0,0 +1,149 @@
+package sendmail_test
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/test"
+)
+
+func TestParseMTASTSPolicy(t *testing.T) {
+	policy, err := sendmail.ParseMTASTSPolicy([]byte("version: STSv1\r\nmode: enforce\r\nmx: mail.example.com\r\nmx: *.example.net\r\nmax_age: 86400\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Mode != sendmail.MTASTSModeEnforce {
+		t.Error("Expected enforce mode, got", policy.Mode)
+	}
+	if policy.MaxAge.Seconds() != 86400 {
+		t.Error("Expected max_age 86400, got", policy.MaxAge)
+	}
+	matches := map[string]bool{
+		"mail.example.com":  true,
+		"MAIL.example.com.": true,
+		"mx1.example.net":   true,
+		"a.mx.example.net":  false,
+		"example.net":       false,
+		"mail.example.org":  false,
+	}
+	for host, expected := range matches {
+		if policy.Match(host) != expected {
+			t.Error("Expected match", expected, "for", host)
+		}
+	}
+
+	for _, invalid := range []string{
+		"version: STSv2\nmode: enforce\nmx: a.example.com\nmax_age: 1\n",
+		"version: STSv1\nmode: unknown\nmx: a.example.com\nmax_age: 1\n",
+		"version: STSv1\nmode: enforce\nmax_age: 1\n",
+		"version: STSv1\nmode: enforce\nmx: a.example.com\n",
+	} {
+		if _, err := sendmail.ParseMTASTSPolicy([]byte(invalid)); err == nil {
+			t.Errorf("Expected error for policy %q", invalid)
+		}
+	}
+}
+
+// newTestMTASTS return MTA-STS fetcher which resolves every domain to
+// a local HTTPS server serving policy
+func newTestMTASTS(t *testing.T, policy string) (*sendmail.MTASTS, *int32) {
+	fetches := new(int32)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(fetches, 1)
+		if r.URL.Path != "/.well-known/mta-sts.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, policy)
+	}))
+	t.Cleanup(ts.Close)
+
+	client := ts.Client()
+	transport := client.Transport.(*http.Transport)
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, ts.Listener.Addr().String())
+	}
+	// The test certificate is valid for *.example.com
+	transport.TLSClientConfig.ServerName = "mta-sts.example.com"
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	transport.TLSClientConfig.RootCAs = roots
+
+	return &sendmail.MTASTS{
+		Resolver: &sendmail.StaticResolver{TXT: map[string][]string{
+			"_mta-sts.example.com": {"v=STSv1; id=20240101T000000"},
+			"_mta-sts.localhost":   {"v=STSv1; id=20240101T000000"},
+		}},
+		HTTPClient: client,
+	}, fetches
+}
+
+func TestMTASTSPolicy(t *testing.T) {
+	mtasts, fetches := newTestMTASTS(t, "version: STSv1\nmode: testing\nmx: mx.example.com\nmax_age: 3600\n")
+
+	for i := 0; i < 2; i++ {
+		policy, err := mtasts.Policy("example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if policy == nil || policy.Mode != sendmail.MTASTSModeTesting || policy.ID != "20240101T000000" {
+			t.Fatal("Unexpected policy", policy)
+		}
+	}
+	if *fetches != 1 {
+		t.Error("Expected cached policy, got", *fetches, "fetches")
+	}
+
+	policy, err := mtasts.Policy("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy != nil {
+		t.Error("Expected no policy, got", policy)
+	}
+}
+
+func TestSendLikeMTAWithMTASTS(t *testing.T) {
+	go test.StartSMTP()
+	test.WaitSMTP()
+
+	tests := []struct {
+		mode      string
+		delivered bool
+	}{
+		{sendmail.MTASTSModeTesting, true},
+		{sendmail.MTASTSModeEnforce, false},
+	}
+	for _, tt := range tests {
+		mtasts, _ := newTestMTASTS(t, "version: STSv1\nmode: "+tt.mode+"\nmx: mx.example.com\nmax_age: 3600\n")
+		envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelope.MTASTS = mtasts
+
+		var delivered, violation bool
+		for result := range envelope.SendLikeMTA() {
+			if result.Message == "MTA-STS" && result.Fields["mode"] == tt.mode {
+				violation = true
+			}
+			if result.Level == sendmail.InfoLevel && result.Fields["recipient"] == "recipient@localhost" {
+				delivered = true
+			}
+		}
+		if !violation {
+			t.Error(tt.mode, "expected MTA-STS violation")
+		}
+		if delivered != tt.delivered {
+			t.Error(tt.mode, "expected delivered", tt.delivered, "got", delivered)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package sendmail
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default queue settings
+const (
+	DefaultQueueInterval    = time.Minute
+	DefaultQueueMinBackoff  = 5 * time.Minute
+	DefaultQueueMaxBackoff  = 4 * time.Hour
+	DefaultQueueMaxLifetime = 5 * 24 * time.Hour
+)
+
+const queueEntryExt = ".json"
+
+// Queue is a persistent on-disk spool of messages waiting for a delivery retry.
+type Queue struct {
+	// Dir is the spool directory
+	Dir string
+	// Interval between scans of the spool by Run
+	Interval time.Duration
+	// MinBackoff is the delay before the first retry, it doubles with every attempt
+	MinBackoff time.Duration
+	// MaxBackoff limits the delay between retries
+	MaxBackoff time.Duration
+	// MaxLifetime after which an undelivered message is given up
+	MaxLifetime time.Duration
+	// Prepare is called for every message taken from the queue before
+	// delivery to apply settings which are not stored, such as MTA-STS
+	Prepare func(*Envelope)
+
+	mu sync.Mutex
+	// inflight are IDs of entries being delivered
+	inflight map[string]bool
+}
+
+// QueueEntry is a message stored in the queue
+type QueueEntry struct {
+	ID          string    `json:"id"`
+	Sender      string    `json:"sender"`
+	Recipients  []string  `json:"recipients"`
+	PortSMTP    string    `json:"port_smtp"`
+	TLSPolicy   TLSPolicy `json:"tls_policy"`
+	Message     []byte    `json:"message"`
+	Created     time.Time `json:"created"`
+	NextAttempt time.Time `json:"next_attempt"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error,omitempty"`
+	Bounce      bool      `json:"bounce,omitempty"`
+}
+
+// NewQueue return queue spooled in dir with default settings.
+// The directory is created if it does not exist.
+func NewQueue(dir string) (*Queue, error) {
+	if dir == "" {
+		return nil, errors.New("empty queue directory")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Queue{
+		Dir:         dir,
+		Interval:    DefaultQueueInterval,
+		MinBackoff:  DefaultQueueMinBackoff,
+		MaxBackoff:  DefaultQueueMaxBackoff,
+		MaxLifetime: DefaultQueueMaxLifetime,
+	}, nil
+}
+
+// Enqueue store generated message of envelope for the given recipients.
+// It is assumed that one delivery attempt has already been made.
+// It returns the queue ID of the new entry.
+func (q *Queue) Enqueue(e *Envelope, recipients []string, message []byte) (string, error) {
+	return q.enqueue(e, recipients, message, 1)
+}
+
+// Accept generate message of envelope, signed if DKIM is set, and store it
+// before any delivery attempt, so that it survives a restart. The caller is
+// expected to Deliver it, otherwise it is delivered by the queue runner
+// after MinBackoff. It returns the queue ID of the new entry.
+func (q *Queue) Accept(e *Envelope) (string, error) {
+	message, err := e.signedMessage()
+	if err != nil {
+		return "", err
+	}
+	return q.enqueue(e, e.Recipients, message, 0)
+}
+
+// Deliver make the first delivery attempt of an entry stored by Accept,
+// the entry is removed once every recipient got a final status, otherwise
+// it is kept with the deferred recipients for a retry. Entries which were
+// attempted already are left to the queue runner.
+// It returns channel for results of send which is closed at the end.
+func (q *Queue) Deliver(id string) <-chan Result {
+	results := make(chan Result)
+	go func() {
+		defer close(results)
+		if !q.claim(id) {
+			// Delivered by the queue runner
+			return
+		}
+		defer q.release(id)
+		entry, err := q.load(id)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				results <- Result{ErrorLevel, err, "Queue", Fields{"queue_id": id}}
+			}
+			return
+		}
+		if entry.Attempts == 0 {
+			q.process(entry, time.Now(), results)
+		}
+	}()
+	return results
+}
+
+// Remove delete entry from the queue, it is not an error if there is no entry.
+func (q *Queue) Remove(id string) error {
+	if err := q.remove(id); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (q *Queue) enqueue(e *Envelope, recipients []string, message []byte, attempts int) (string, error) {
+	now := time.Now()
+	sender := e.mailFrom()
+	if sender == "" {
+		sender = NullSender
+	}
+	entry := &QueueEntry{
+		ID:          generateQueueID(),
+		Sender:      sender,
+		Recipients:  recipients,
+		PortSMTP:    e.PortSMTP,
+		TLSPolicy:   e.TLSPolicy,
+		Message:     message,
+		Created:     now,
+		NextAttempt: now.Add(q.backoff(attempts)),
+		Attempts:    attempts,
+		Bounce:      e.Bounce,
+	}
+	if err := q.save(entry); err != nil {
+		return "", err
+	}
+	return entry.ID, nil
+}
+
+// Entries return all messages in the queue ordered by creation time.
+func (q *Queue) Entries() ([]*QueueEntry, error) {
+	files, err := ioutil.ReadDir(q.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*QueueEntry
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), queueEntryExt) {
+			continue
+		}
+		entry, err := q.load(strings.TrimSuffix(file.Name(), queueEntryExt))
+		if os.IsNotExist(err) {
+			// Removed after delivery meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries, nil
+}
+
+// Flush makes a delivery attempt for every queued message which is due.
+// It returns channel for results of send.
+// After the end of processing channel are closed.
+func (q *Queue) Flush() <-chan Result {
+	results := make(chan Result)
+	go func() {
+		q.flush(results)
+		close(results)
+	}()
+	return results
+}
+
+// Run process the queue every Interval until stop is closed.
+// It returns channel for results of send which must be drained.
+// The channel is closed after stop.
+func (q *Queue) Run(stop <-chan struct{}) <-chan Result {
+	results := make(chan Result)
+	go func() {
+		defer close(results)
+		interval := q.Interval
+		if interval <= 0 {
+			interval = DefaultQueueInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			q.flush(results)
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return results
+}
+
+func (q *Queue) flush(results chan<- Result) {
+	entries, err := q.Entries()
+	if err != nil {
+		results <- Result{ErrorLevel, err, "Queue", Fields{"queue": q.Dir}}
+		return
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		id := entry.ID
+		if entry.NextAttempt.After(now) || !q.claim(id) {
+			continue
+		}
+		// The entry may have changed before it was claimed
+		entry, err := q.load(id)
+		if err == nil && !entry.NextAttempt.After(now) {
+			q.process(entry, now, results)
+		} else if err != nil && !os.IsNotExist(err) {
+			results <- Result{ErrorLevel, err, "Queue", Fields{"queue_id": id}}
+		}
+		q.release(id)
+	}
+}
+
+// claim mark entry as being delivered, it reports false
+// if the entry is already delivered by someone else.
+func (q *Queue) claim(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.inflight[id] {
+		return false
+	}
+	if q.inflight == nil {
+		q.inflight = make(map[string]bool)
+	}
+	q.inflight[id] = true
+	return true
+}
+
+func (q *Queue) release(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.inflight, id)
+}
+
+// process make a delivery attempt of entry by the routing of the envelope,
+// as Envelope.Send does, and remove it or save it with the deferred recipients.
+func (q *Queue) process(entry *QueueEntry, now time.Time, results chan<- Result) {
+	fields := Fields{
+		"sender":     entry.Sender,
+		"recipients": strings.Join(entry.Recipients, ","),
+		"queue_id":   entry.ID,
+		"attempts":   entry.Attempts,
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(entry.Message))
+	if err != nil {
+		results <- Result{ErrorLevel, err, "Queue", fields}
+		return
+	}
+	envelope := &Envelope{
+		Message:    msg,
+		Sender:     entry.Sender,
+		Recipients: entry.Recipients,
+		PortSMTP:   entry.PortSMTP,
+		TLSPolicy:  entry.TLSPolicy,
+		Queue:      q,
+		Bounce:     entry.Bounce,
+	}
+	if q.Prepare != nil {
+		q.Prepare(envelope)
+	}
+	if q.MaxLifetime > 0 && now.Sub(entry.Created) > q.MaxLifetime {
+		if err := q.remove(entry.ID); err != nil {
+			results <- Result{ErrorLevel, err, "Queue", fields}
+			return
+		}
+		results <- Result{ErrorLevel, errors.New("message expired in queue"), entry.LastError, fields}
+		if entry.Bounce {
+			var failed []FailedRecipient
+			for _, recipient := range entry.Recipients {
+				failed = append(failed, FailedRecipient{
+					Recipient: recipient,
+					// Delivery time expired
+					Status:  "4.4.7",
+					Message: "message expired in queue, last error: " + entry.LastError,
+				})
+			}
+			envelope.bounce(entry.Message, failed, (*Envelope).Send, results)
+		}
+		return
+	}
+	report := q.attempt(entry, envelope, results)
+	if entry.Bounce && len(report.failed) > 0 {
+		envelope.bounce(entry.Message, report.failed, (*Envelope).Send, results)
+	}
+	deferred := report.deferred
+	if len(deferred) == 0 {
+		if err := q.remove(entry.ID); err != nil {
+			results <- Result{ErrorLevel, err, "Queue", fields}
+			return
+		}
+		results <- Result{InfoLevel, nil, "Removed from queue", fields}
+		return
+	}
+	entry.Recipients = deferred
+	entry.Attempts++
+	entry.NextAttempt = time.Now().Add(q.backoff(entry.Attempts))
+	if err := q.save(entry); err != nil {
+		results <- Result{ErrorLevel, err, "Queue", fields}
+		return
+	}
+	fields["recipients"] = strings.Join(deferred, ",")
+	fields["next_attempt"] = entry.NextAttempt
+	results <- Result{WarnLevel, errors.New("delivery deferred"), "Queue", fields}
+}
+
+// backoff return delay before the given attempt number.
+func (q *Queue) backoff(attempts int) time.Duration {
+	delay := q.MinBackoff
+	for i := 1; i < attempts && delay < q.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if q.MaxBackoff > 0 && delay > q.MaxBackoff {
+		delay = q.MaxBackoff
+	}
+	return delay
+}
+
+func (q *Queue) path(id string) string {
+	return filepath.Join(q.Dir, id+queueEntryExt)
+}
+
+func (q *Queue) load(id string) (*QueueEntry, error) {
+	data, err := ioutil.ReadFile(q.path(id))
+	if err != nil {
+		return nil, err
+	}
+	entry := &QueueEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// save write entry atomically via temporary file.
+func (q *Queue) save(entry *QueueEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(q.Dir, entry.ID+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), q.path(entry.ID))
+}
+
+func (q *Queue) remove(id string) error {
+	return os.Remove(q.path(id))
+}
+
+// attempt deliver queued entry once, remembering the last delivery error.
+func (q *Queue) attempt(entry *QueueEntry, envelope *Envelope, results chan<- Result) deliveryReport {
+	attemptResults := make(chan Result)
+	done := make(chan struct{})
+	go func() {
+		for result := range attemptResults {
+			if result.Error != nil {
+				entry.LastError = result.Error.Error()
+			}
+			results <- result
+		}
+		close(done)
+	}()
+	report := envelope.deliver(entry.Message, attemptResults)
+	close(attemptResults)
+	<-done
+	return report
+}
@@ -0,0 +1,346 @@
+package sendmail_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/test"
+)
+
+func newTestQueue(t *testing.T) *sendmail.Queue {
+	queue, err := sendmail.NewQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.MinBackoff = 0
+	return queue
+}
+
+func TestQueueFlush(t *testing.T) {
+	go test.StartSMTP()
+	test.WaitSMTP()
+
+	queue := newTestQueue(t)
+	envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := envelope.GenerateMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := queue.Enqueue(&envelope, envelope.Recipients, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := queue.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != id {
+		t.Fatal("Expected queued entry", id, "got", entries)
+	}
+
+	for result := range queue.Flush() {
+		if result.Level < sendmail.WarnLevel {
+			t.Error(result.Error)
+		}
+	}
+
+	entries, err = queue.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Error("Expected empty queue, got", len(entries), "entries")
+	}
+}
+
+func TestQueueDeferred(t *testing.T) {
+	queue := newTestQueue(t)
+	queue.MinBackoff = time.Hour
+	config := testConfigs[0].initial
+	config.PortSMTP = "1"
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.Queue = queue
+
+	queued := false
+	for result := range envelope.SendLikeMTA() {
+		if result.Message == "Queued for retry" {
+			queued = true
+		} else if result.Level < sendmail.WarnLevel {
+			t.Error(result.Error)
+		}
+	}
+	if !queued {
+		t.Fatal("Expected message to be queued")
+	}
+
+	entries, err := queue.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatal("Expected one queued entry, got", len(entries))
+	}
+	if entries[0].Attempts != 1 || !entries[0].NextAttempt.After(time.Now()) {
+		t.Error("Expected next attempt in the future, got", entries[0].NextAttempt)
+	}
+
+	// Not due yet
+	for result := range queue.Flush() {
+		t.Error("Unexpected result", result)
+	}
+}
+
+// timeoutResolver fails every lookup with a temporary error
+type timeoutResolver struct{}
+
+func (timeoutResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+}
+
+func (timeoutResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+}
+
+func (timeoutResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+}
+
+func TestQueueDeferredLookup(t *testing.T) {
+	queue := newTestQueue(t)
+	config := testConfigs[0].initial
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.Queue = queue
+	envelope.Resolver = timeoutResolver{}
+
+	var last sendmail.Result
+	for result := range envelope.SendLikeMTA() {
+		if result.Level < sendmail.WarnLevel {
+			t.Error("Expected no error for deferred recipients, got", result.Error)
+		}
+		last = result
+	}
+	if last.Message != "Queued for retry" {
+		t.Error("Expected message queued at last, got", last)
+	}
+	entries, err := queue.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Error("Expected one queued entry, got", len(entries))
+	}
+}
+
+func TestQueueExpired(t *testing.T) {
+	queue := newTestQueue(t)
+	queue.MaxLifetime = time.Nanosecond
+	envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := envelope.GenerateMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Enqueue(&envelope, envelope.Recipients, message); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	expired := false
+	for result := range queue.Flush() {
+		if result.Level == sendmail.ErrorLevel && result.Error.Error() == "message expired in queue" {
+			expired = true
+		}
+	}
+	if !expired {
+		t.Error("Expected message to expire")
+	}
+
+	entries, err := queue.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Error("Expected empty queue, got", len(entries), "entries")
+	}
+}
+
+func TestQueueAccept(t *testing.T) {
+	queue := newTestQueue(t)
+	queue.MinBackoff = time.Hour
+	envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := queue.Accept(&envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := queue.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != id {
+		t.Fatal("Expected accepted entry", id, "got", entries)
+	}
+	if entries[0].Attempts != 0 {
+		t.Error("Expected no attempts, got", entries[0].Attempts)
+	}
+	if !entries[0].NextAttempt.After(time.Now()) {
+		t.Error("Expected retry after backoff, got", entries[0].NextAttempt)
+	}
+
+	if err := queue.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Remove(id); err != nil {
+		t.Error("Expected no error for removed entry, got", err)
+	}
+	entries, err = queue.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Error("Expected empty queue, got", len(entries), "entries")
+	}
+}
+
+func TestQueueDeliver(t *testing.T) {
+	queue := newTestQueue(t)
+	m, err := sendmail.ParseTransportMap(strings.NewReader("local.test local\ndead.test smtp://localhost:1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.LocalDir = t.TempDir()
+	queue.Prepare = func(e *sendmail.Envelope) {
+		e.Transports = m
+	}
+	config := testConfigs[0].initial
+	config.Recipients = []string{"user@local.test", "user@dead.test"}
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := queue.Accept(&envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range queue.Deliver(id) {
+	}
+	if _, err := os.Stat(filepath.Join(m.LocalDir, "user")); err != nil {
+		t.Error("Expected delivery to the local mailbox, got", err)
+	}
+	entries, err := queue.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != id {
+		t.Fatal("Expected entry kept for the deferred recipient, got", entries)
+	}
+	if len(entries[0].Recipients) != 1 || entries[0].Recipients[0] != "user@dead.test" || entries[0].Attempts != 1 {
+		t.Error("Expected deferred user@dead.test after one attempt, got", entries[0].Recipients, entries[0].Attempts)
+	}
+
+	// Attempted entries are left to the queue runner
+	for result := range queue.Deliver(id) {
+		t.Error("Unexpected result", result)
+	}
+	for range queue.Flush() {
+	}
+	entries, err = queue.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Attempts != 2 {
+		t.Error("Expected second attempt by the queue runner, got", entries)
+	}
+}
+
+func TestQueueDeliverOnce(t *testing.T) {
+	queue := newTestQueue(t)
+	m, err := sendmail.ParseTransportMap(strings.NewReader("local.test local\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.LocalDir = t.TempDir()
+	queue.Prepare = func(e *sendmail.Envelope) {
+		e.Transports = m
+	}
+	config := testConfigs[0].initial
+	config.Recipients = []string{"user@local.test"}
+	const messages = 20
+	var ids []string
+	for i := 0; i < messages; i++ {
+		envelope, err := sendmail.NewEnvelope(&config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Due at once for the queue runner
+		id, err := queue.Accept(&envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for result := range queue.Flush() {
+				if result.Level < sendmail.WarnLevel {
+					t.Error(result.Error)
+				}
+			}
+		}()
+	}
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			for result := range queue.Deliver(id) {
+				if result.Level < sendmail.WarnLevel {
+					t.Error(result.Error)
+				}
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	mbox, err := ioutil.ReadFile(filepath.Join(m.LocalDir, "user"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(mbox), "\nFrom sender@localhost ") + 1; n != messages {
+		t.Error("Expected", messages, "delivered messages, got", n)
+	}
+	entries, err := queue.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Error("Expected empty queue, got", len(entries), "entries")
+	}
+}
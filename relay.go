@@ -0,0 +1,254 @@
+package sendmail
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default circuit breaker settings of RelayPool
+const (
+	DefaultRelayFailureThreshold = 3
+	DefaultRelayCooldown         = time.Minute
+)
+
+// Relay is a smart host of a RelayPool
+type Relay struct {
+	// URL of the smart host, see SendSmarthost
+	URL string
+	// Priority of the relay, lower values are tried first
+	Priority int
+	// Weight of the relay among relays with the same priority,
+	// traffic is spread randomly in proportion to weights, 1 if zero
+	Weight int
+	// Credentials for authentication (optional)
+	Credentials Credentials
+}
+
+// ParseRelays parse comma separated list of smart hosts with optional
+// priority and weight query parameters, such as
+// "smtps://a.example.com?priority=10&weight=3, b.example.com:25?priority=20".
+func ParseRelays(list string) ([]Relay, error) {
+	var relays []Relay
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		relay := Relay{URL: item, Weight: 1}
+		if i := strings.IndexByte(item, '?'); i >= 0 {
+			relay.URL = item[:i]
+			query, err := url.ParseQuery(item[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid smart host %s: %v", item, err)
+			}
+			for key, values := range query {
+				value, err := strconv.Atoi(values[0])
+				if err != nil || value < 0 {
+					return nil, fmt.Errorf("invalid smart host %s: bad %s", item, key)
+				}
+				switch key {
+				case "priority":
+					relay.Priority = value
+				case "weight":
+					relay.Weight = value
+				default:
+					return nil, fmt.Errorf("invalid smart host %s: unknown parameter %s", item, key)
+				}
+			}
+		}
+		relays = append(relays, relay)
+	}
+	if len(relays) == 0 {
+		return nil, fmt.Errorf("no smart hosts in %q", list)
+	}
+	return relays, nil
+}
+
+type relayHealth struct {
+	failures  int
+	openUntil time.Time
+}
+
+// RelayPool is a list of smart hosts with failover. A relay that failed
+// FailureThreshold times in a row is considered unhealthy for Cooldown
+// and tried only after the healthy ones.
+// It is safe for concurrent use and should be shared between envelopes.
+type RelayPool struct {
+	Relays []Relay
+	// FailureThreshold of consecutive failures opening the circuit breaker,
+	// DefaultRelayFailureThreshold if zero
+	FailureThreshold int
+	// Cooldown of an unhealthy relay, DefaultRelayCooldown if zero
+	Cooldown time.Duration
+
+	mu     sync.Mutex
+	health map[string]*relayHealth
+}
+
+// NewRelayPool return pool of relays
+func NewRelayPool(relays ...Relay) *RelayPool {
+	return &RelayPool{Relays: relays}
+}
+
+// Healthy reports whether the circuit breaker of relay URL is closed
+func (p *RelayPool) Healthy(url string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	health := p.health[url]
+	return health == nil || !time.Now().Before(health.openUntil)
+}
+
+// CopyHealth take over the circuit breaker state of relays with the same URL
+// from the other pool, such as the pool replaced by a configuration reload.
+func (p *RelayPool) CopyHealth(other *RelayPool) {
+	if other == nil || other == p {
+		return
+	}
+	other.mu.Lock()
+	health := make(map[string]relayHealth)
+	for _, relay := range p.Relays {
+		if h := other.health[relay.URL]; h != nil {
+			health[relay.URL] = *h
+		}
+	}
+	other.mu.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.health == nil {
+		p.health = make(map[string]*relayHealth)
+	}
+	for url, h := range health {
+		h := h
+		p.health[url] = &h
+	}
+}
+
+// report record outcome of a delivery attempt through the relay
+func (p *RelayPool) report(url string, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.health == nil {
+		p.health = make(map[string]*relayHealth)
+	}
+	health := p.health[url]
+	if health == nil {
+		health = &relayHealth{}
+		p.health[url] = health
+	}
+	if ok {
+		health.failures = 0
+		health.openUntil = time.Time{}
+		return
+	}
+	health.failures++
+	threshold := p.FailureThreshold
+	if threshold <= 0 {
+		threshold = DefaultRelayFailureThreshold
+	}
+	if health.failures >= threshold {
+		cooldown := p.Cooldown
+		if cooldown <= 0 {
+			cooldown = DefaultRelayCooldown
+		}
+		health.openUntil = time.Now().Add(cooldown)
+	}
+}
+
+// order return relays to try: by priority, weighted random within the
+// same priority, unhealthy relays last.
+func (p *RelayPool) order() []Relay {
+	relays := make([]Relay, len(p.Relays))
+	copy(relays, p.Relays)
+	sort.SliceStable(relays, func(i, j int) bool {
+		return relays[i].Priority < relays[j].Priority
+	})
+	for start := 0; start < len(relays); {
+		end := start
+		for end < len(relays) && relays[end].Priority == relays[start].Priority {
+			end++
+		}
+		weightedShuffle(relays[start:end])
+		start = end
+	}
+	var healthy, unhealthy []Relay
+	for _, relay := range relays {
+		if p.Healthy(relay.URL) {
+			healthy = append(healthy, relay)
+		} else {
+			unhealthy = append(unhealthy, relay)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// weightedShuffle order relays randomly, a relay is picked first
+// with probability proportional to its weight.
+func weightedShuffle(relays []Relay) {
+	for i := range relays {
+		total := 0
+		for _, relay := range relays[i:] {
+			total += relayWeight(relay)
+		}
+		n := rand.Intn(total)
+		for j := i; j < len(relays); j++ {
+			n -= relayWeight(relays[j])
+			if n < 0 {
+				relays[i], relays[j] = relays[j], relays[i]
+				break
+			}
+		}
+	}
+}
+
+// relayWeight return weight of relay, 1 if it is not set
+func relayWeight(relay Relay) int {
+	if relay.Weight <= 0 {
+		return 1
+	}
+	return relay.Weight
+}
+
+var (
+	envRelayMu   sync.Mutex
+	envRelayKey  string
+	envRelayPool *RelayPool
+)
+
+// EnvRelayPool return pool of the smart hosts listed in SENDMAIL_SMART_HOST
+// with credentials from SENDMAIL_SMART_LOGIN, SENDMAIL_SMART_PASSWORD,
+// SENDMAIL_SMART_AUTH, SENDMAIL_SMART_TOKEN and SENDMAIL_SMART_TOKEN_FILE.
+// The pool is kept while the variables are unchanged,
+// so the health of relays is tracked across messages.
+func EnvRelayPool() (*RelayPool, error) {
+	credentials := Credentials{
+		Login:     os.Getenv("SENDMAIL_SMART_LOGIN"),
+		Password:  os.Getenv("SENDMAIL_SMART_PASSWORD"),
+		Mechanism: os.Getenv("SENDMAIL_SMART_AUTH"),
+		Token:     os.Getenv("SENDMAIL_SMART_TOKEN"),
+		TokenFile: os.Getenv("SENDMAIL_SMART_TOKEN_FILE"),
+	}
+	key := fmt.Sprintf("%s\x00%+v", os.Getenv("SENDMAIL_SMART_HOST"), credentials)
+
+	envRelayMu.Lock()
+	defer envRelayMu.Unlock()
+	if envRelayPool != nil && envRelayKey == key {
+		return envRelayPool, nil
+	}
+	relays, err := ParseRelays(os.Getenv("SENDMAIL_SMART_HOST"))
+	if err != nil {
+		return nil, err
+	}
+	for i := range relays {
+		relays[i].Credentials = credentials
+	}
+	envRelayKey, envRelayPool = key, NewRelayPool(relays...)
+	return envRelayPool, nil
+}
@@ -0,0 +1,130 @@
+package sendmail_test
+
+import (
+	"testing"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/test"
+)
+
+func TestParseRelays(t *testing.T) {
+	relays, err := sendmail.ParseRelays("smtps://a.example.com?priority=10&weight=3, b.example.com:25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(relays) != 2 {
+		t.Fatal("Expected 2 relays, got", relays)
+	}
+	if relays[0].URL != "smtps://a.example.com" || relays[0].Priority != 10 || relays[0].Weight != 3 {
+		t.Error("Unexpected relay", relays[0])
+	}
+	if relays[1].URL != "b.example.com:25" || relays[1].Priority != 0 || relays[1].Weight != 1 {
+		t.Error("Unexpected relay", relays[1])
+	}
+	for _, list := range []string{"", "a.example.com?priority=high", "a.example.com?ttl=1"} {
+		if _, err := sendmail.ParseRelays(list); err == nil {
+			t.Error("Expected error for", list)
+		}
+	}
+}
+
+func TestSendRelaysFailover(t *testing.T) {
+	go test.StartSMTP()
+	test.WaitSMTP()
+
+	dead := "localhost:1"
+	alive := "localhost:" + test.PortSMTP
+	pool := sendmail.NewRelayPool(
+		sendmail.Relay{URL: alive, Priority: 10},
+		sendmail.Relay{URL: dead, Priority: 0},
+	)
+	pool.FailureThreshold = 1
+
+	for i, expectedAttempts := range []int{2, 1} {
+		envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attempts := 0
+		for result := range envelope.SendRelays(pool) {
+			switch result.Level {
+			case sendmail.InfoLevel:
+				attempts++
+				if result.Fields["smarthost"] != alive {
+					t.Error("Expected delivery through", alive, "got", result.Fields["smarthost"])
+				}
+			case sendmail.WarnLevel:
+				attempts++
+				if result.Fields["smarthost"] != dead {
+					t.Error("Unexpected failure", result.Error)
+				}
+			default:
+				t.Error(result.Error)
+			}
+		}
+		if attempts != expectedAttempts {
+			t.Error("Send", i, "expected", expectedAttempts, "attempts, got", attempts)
+		}
+		if pool.Healthy(dead) {
+			t.Error("Expected", dead, "to be unhealthy")
+		}
+	}
+}
+
+func TestSendRelaysWeight(t *testing.T) {
+	go test.StartSMTP()
+	test.WaitSMTP()
+
+	// Both relays are the same server, only the URLs differ
+	unset := "localhost:" + test.PortSMTP
+	one := "127.0.0.1:" + test.PortSMTP
+	pool := sendmail.NewRelayPool(
+		sendmail.Relay{URL: unset},
+		sendmail.Relay{URL: one, Weight: 1},
+	)
+	used := make(map[interface{}]int)
+	for i := 0; i < 100; i++ {
+		envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for result := range envelope.SendRelays(pool) {
+			if result.Level != sendmail.InfoLevel {
+				t.Fatal(result.Error)
+			}
+			used[result.Fields["smarthost"]]++
+		}
+	}
+	if used[unset] < 20 || used[one] < 20 {
+		t.Error("Expected relays without weight and of weight 1 used alike, got", used)
+	}
+}
+
+func TestRelayPoolCopyHealth(t *testing.T) {
+	dead := "localhost:1"
+	pool := sendmail.NewRelayPool(sendmail.Relay{URL: dead})
+	pool.FailureThreshold = 1
+	envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range envelope.SendRelays(pool) {
+	}
+	if pool.Healthy(dead) {
+		t.Fatal("Expected", dead, "to be unhealthy")
+	}
+
+	reloaded := sendmail.NewRelayPool(sendmail.Relay{URL: dead}, sendmail.Relay{URL: "localhost:2"})
+	reloaded.CopyHealth(pool)
+	if reloaded.Healthy(dead) {
+		t.Error("Expected", dead, "to stay unhealthy")
+	}
+	if !reloaded.Healthy("localhost:2") {
+		t.Error("Expected new relay to be healthy")
+	}
+	other := sendmail.NewRelayPool(sendmail.Relay{URL: "localhost:2"})
+	other.CopyHealth(pool)
+	if !other.Healthy(dead) {
+		t.Error("Expected no state of relays missing in the pool")
+	}
+}
@@ -0,0 +1,94 @@
+package sendmail
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Resolver looks up DNS records needed for delivery
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	// LookupIP return IPv4 and IPv6 addresses of host
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DefaultResolver is used when no resolver is configured
+var DefaultResolver Resolver = &NetResolver{}
+
+// NetResolver is a Resolver backed by net.Resolver
+type NetResolver struct {
+	// Resolver to use, net.DefaultResolver if nil
+	Resolver *net.Resolver
+}
+
+func (r *NetResolver) resolver() *net.Resolver {
+	if r.Resolver != nil {
+		return r.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// LookupMX return MX records of name sorted by preference
+func (r *NetResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return r.resolver().LookupMX(ctx, name)
+}
+
+// LookupIP return IPv4 and IPv6 addresses of host
+func (r *NetResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return r.resolver().LookupIP(ctx, "ip", host)
+}
+
+// LookupTXT return TXT records of name
+func (r *NetResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return r.resolver().LookupTXT(ctx, name)
+}
+
+// StaticResolver answers from fixed records, names are not fully qualified.
+// It is intended for tests.
+type StaticResolver struct {
+	MX  map[string][]*net.MX
+	IP  map[string][]net.IP
+	TXT map[string][]string
+}
+
+func staticName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// LookupMX return MX records of name
+func (r *StaticResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if records, ok := r.MX[staticName(name)]; ok {
+		return records, nil
+	}
+	return nil, notFound(name)
+}
+
+// LookupIP return addresses of host
+func (r *StaticResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if records, ok := r.IP[staticName(host)]; ok {
+		return records, nil
+	}
+	return nil, notFound(host)
+}
+
+// LookupTXT return TXT records of name
+func (r *StaticResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if records, ok := r.TXT[staticName(name)]; ok {
+		return records, nil
+	}
+	return nil, notFound(name)
+}
+
+// resolver return configured resolver of envelope or the default one
+func (e *Envelope) resolver() Resolver {
+	if e.Resolver != nil {
+		return e.Resolver
+	}
+	return DefaultResolver
+}
@@ -0,0 +1,111 @@
+package sendmail_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/test"
+)
+
+func TestStaticResolver(t *testing.T) {
+	resolver := &sendmail.StaticResolver{
+		MX: map[string][]*net.MX{"example.com": {{Host: "mx.example.com.", Pref: 10}}},
+	}
+	records, err := resolver.LookupMX(context.Background(), "EXAMPLE.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Host != "mx.example.com." {
+		t.Error("Unexpected records", records)
+	}
+	_, err = resolver.LookupIP(context.Background(), "mx.example.com")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+		t.Error("Expected not found error, got", err)
+	}
+}
+
+func TestDNSResolver(t *testing.T) {
+	header := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: 300}
+	}
+	addr, stop := test.StartDNS(map[string][]dns.RR{
+		"example.com.": {
+			&dns.MX{Hdr: header("example.com.", dns.TypeMX), Preference: 20, Mx: "mx2.example.com."},
+			&dns.MX{Hdr: header("example.com.", dns.TypeMX), Preference: 10, Mx: "mx1.example.com."},
+			&dns.TXT{Hdr: header("example.com.", dns.TypeTXT), Txt: []string{"v=spf1 ", "-all"}},
+		},
+		"mx1.example.com.": {
+			&dns.A{Hdr: header("mx1.example.com.", dns.TypeA), A: net.ParseIP("127.0.0.1")},
+			&dns.AAAA{Hdr: header("mx1.example.com.", dns.TypeAAAA), AAAA: net.ParseIP("::1")},
+		},
+	}, false)
+	defer stop()
+
+	resolver := &sendmail.DNSResolver{Server: addr}
+	ctx := context.Background()
+
+	mx, err := resolver.LookupMX(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mx) != 2 || mx[0].Host != "mx1.example.com." {
+		t.Error("Expected MX sorted by preference, got", mx)
+	}
+
+	_, ttl, err := resolver.LookupMXWithTTL(ctx, "example.com")
+	if err != nil || ttl != 300*time.Second {
+		t.Error("Expected TTL of 300s, got", ttl, err)
+	}
+
+	ips, err := resolver.LookupIP(ctx, "mx1.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 {
+		t.Error("Expected IPv4 and IPv6 addresses, got", ips)
+	}
+
+	txt, err := resolver.LookupTXT(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txt) != 1 || txt[0] != "v=spf1 -all" {
+		t.Error("Unexpected TXT records", txt)
+	}
+
+	_, err = resolver.LookupMX(ctx, "example.org")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+		t.Error("Expected not found error, got", err)
+	}
+}
+
+func TestSendLikeMTAWithResolver(t *testing.T) {
+	go test.StartSMTP()
+	test.WaitSMTP()
+
+	envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.Resolver = &sendmail.StaticResolver{
+		MX: map[string][]*net.MX{"localhost": {{Host: "mx.test.", Pref: 10}}},
+		IP: map[string][]net.IP{"mx.test": {net.ParseIP("127.0.0.1")}},
+	}
+
+	delivered := false
+	for result := range envelope.SendLikeMTA() {
+		if result.Level < sendmail.WarnLevel {
+			t.Error(result.Error)
+		}
+		if result.Level == sendmail.InfoLevel && result.Fields["mx"] == "mx.test" {
+			delivered = true
+		}
+	}
+	if !delivered {
+		t.Error("Expected delivery through mx.test")
+	}
+}
@@ -3,18 +3,15 @@ package sendmail
 
 import (
 	"bytes"
-	"encoding/base64"
+	"crypto/tls"
 	"errors"
+	"io/ioutil"
 	"net/mail"
+	"net/textproto"
 	"os"
 	"os/user"
 	"sort"
 	"strings"
-	"sync"
-)
-
-var (
-	wg sync.WaitGroup
 )
 
 // Config of envelope
@@ -23,22 +20,73 @@ type Config struct {
 	Recipients []string
 	Subject    string
 	Body       []byte
-	PortSMTP   string
+	// ExtractRecipients from the To, Cc and Bcc fields even if Recipients
+	// are set, then Recipients are excluded from delivery (sendmail -t).
+	// The fields are always used if there are no Recipients.
+	ExtractRecipients bool
+	// Message is built as the body instead of Body if set
+	Message   *Message
+	PortSMTP  string
+	TLSPolicy TLSPolicy
 }
 
+// NullSender is the envelope sender of messages which must never be
+// bounced, such as delivery status notifications.
+const NullSender = "<>"
+
 // Envelope of message
 type Envelope struct {
 	*mail.Message
+	// Sender is the envelope sender address (MAIL FROM),
+	// the From header address is used if empty
+	Sender     string
 	Recipients []string
 	PortSMTP   string
+	// TLSPolicy for connections to mail servers
+	TLSPolicy TLSPolicy
+	// TLSConfig is the base configuration of TLS connections (optional),
+	// ServerName is set for every server
+	TLSConfig *tls.Config
+	// Resolver for MX and address lookups, DefaultResolver if nil
+	Resolver Resolver
+	// MTASTS enforces MTA-STS policies of recipient domains (optional)
+	MTASTS *MTASTS
+	// DANE verifies MX certificates against TLSA records
+	// looked up with the resolver (optional)
+	DANE TLSAResolver
+	// Transports routes recipients by domain (optional)
+	Transports *TransportMap
+	// Relays for delivery through smart hosts instead of MX (optional),
+	// SENDMAIL_SMART_HOST is used by Send if nil
+	Relays *RelayPool
+	// Queue for messages that could not be delivered right now (optional)
+	Queue *Queue
+	// Bounce enables delivery status notifications to the sender on permanent failure
+	Bounce bool
+	// DKIM signs the message once before sending (optional)
+	DKIM *DKIM
+
+	// fields of the original message, GenerateMessage keeps their order
+	// and bytes unless the value is changed and writes other fields before them
+	fields []headerField
 }
 
 // NewEnvelope return new message envelope
 func NewEnvelope(config *Config) (Envelope, error) {
-	msg, err := mail.ReadMessage(bytes.NewReader(config.Body))
+	body := config.Body
+	if config.Message != nil {
+		var err error
+		if body, err = config.Message.Bytes(); err != nil {
+			return Envelope{}, err
+		}
+	}
+	fields := headerFields(body)
+	msg, err := mail.ReadMessage(bytes.NewReader(body))
 	if err != nil {
-		if len(config.Recipients) > 0 {
-			msg, err = GetDumbMessage(config.Sender, config.Recipients, config.Body)
+		// The body has no header
+		fields = nil
+		if len(config.Recipients) > 0 && !config.ExtractRecipients {
+			msg, err = GetDumbMessage(config.Sender, config.Recipients, body)
 		}
 		if err != nil {
 			return Envelope{}, err
@@ -66,56 +114,184 @@ func NewEnvelope(config *Config) (Envelope, error) {
 	}
 
 	if config.Subject != "" {
-		msg.Header["Subject"] = []string{"=?UTF-8?B?" + base64.StdEncoding.EncodeToString([]byte(config.Subject))}
+		// Encoded by GenerateMessage if needed
+		msg.Header["Subject"] = []string{config.Subject}
 	}
 
 	var recipients []string
 
-	if len(config.Recipients) > 0 {
+	if len(config.Recipients) > 0 && !config.ExtractRecipients {
 		recipient, err := mail.ParseAddressList(strings.Join(config.Recipients, ","))
 		if err == nil {
 			recipients = AddressListToSlice(recipient)
 		}
+		// The builder does not make addressing headers
+		if config.Message != nil && msg.Header.Get("To") == "" {
+			msg.Header["To"] = []string{strings.Join(config.Recipients, ",")}
+		}
 	} else {
-		recipientsList, err := msg.Header.AddressList("To")
-		if err != nil {
-			return Envelope{}, err
+		// Addresses of Config.Recipients are not delivered to, as sendmail -t does
+		excluded := make(map[string]bool)
+		if list, err := mail.ParseAddressList(strings.Join(config.Recipients, ",")); err == nil {
+			for _, address := range list {
+				excluded[strings.ToLower(address.Address)] = true
+			}
 		}
-		rcpt := func(field string) []*mail.Address {
-			if recipient, err := msg.Header.AddressList(field); err == nil {
-				return recipient
+		for _, field := range []string{"To", "Cc", "Bcc"} {
+			list, err := msg.Header.AddressList(field)
+			if err != nil && err != mail.ErrHeaderNotPresent {
+				return Envelope{}, err
+			}
+			for _, address := range list {
+				key := strings.ToLower(address.Address)
+				if !excluded[key] {
+					recipients = append(recipients, address.Address)
+					// Once for every address
+					excluded[key] = true
+				}
 			}
-			return nil
 		}
-		recipientsList = append(recipientsList, rcpt("Cc")...)
-		recipientsList = append(recipientsList, rcpt("Bcc")...)
-		recipients = AddressListToSlice(recipientsList)
 	}
 
+	// Blind copies must not be seen by the other recipients
+	delete(msg.Header, "Bcc")
+
 	if len(recipients) == 0 {
 		return Envelope{}, errors.New("no recipients listed")
 	}
 
+	sender := config.Sender
+	if from, err := mail.ParseAddress(config.Sender); err == nil {
+		sender = from.Address
+	}
+
 	if msg.Header.Get("Message-ID") == "" {
 		msg.Header["Message-ID"] = []string{generateMessageID(GetDomainFromAddress(recipients[0]))}
 	}
 
-	return Envelope{msg, recipients, config.PortSMTP}, nil
+	return Envelope{
+		Message:    msg,
+		Sender:     sender,
+		Recipients: recipients,
+		PortSMTP:   config.PortSMTP,
+		TLSPolicy:  config.TLSPolicy,
+		fields:     fields,
+	}, nil
 }
 
 // Send message.
 // It returns channel for results of send.
 // After the end of sending channel are closed.
 func (e *Envelope) Send() <-chan Result {
-	smartHost := os.Getenv("SENDMAIL_SMART_HOST")
-	if smartHost != "" {
-		return e.SendSmarthost(
-			smartHost,
-			os.Getenv("SENDMAIL_SMART_LOGIN"),
-			os.Getenv("SENDMAIL_SMART_PASSWORD"),
-		)
-	}
-	return e.SendLikeMTA()
+	return e.send((*Envelope).deliver, (*Envelope).Send)
+}
+
+// deliveryReport summarizes a delivery attempt
+type deliveryReport struct {
+	// number of recipients delivered
+	success int
+	// total number of recipients
+	total int
+	// recipients which failed only with temporary errors
+	deferred []string
+	// recipients which failed permanently
+	failed []FailedRecipient
+}
+
+// merge add report of a group of recipients
+func (r *deliveryReport) merge(other deliveryReport) {
+	r.success += other.success
+	r.deferred = append(r.deferred, other.deferred...)
+	r.failed = append(r.failed, other.failed...)
+}
+
+// deliver send generated message by the routing of the envelope:
+// the transport map, the relay pool, SENDMAIL_SMART_HOST or MX hosts.
+func (e *Envelope) deliver(message []byte, results chan<- Result) deliveryReport {
+	if e.Transports != nil {
+		return e.deliverTransports(e.Transports, message, results)
+	}
+	if e.Relays != nil {
+		return e.deliverRelays(e.Relays, message, results)
+	}
+	if os.Getenv("SENDMAIL_SMART_HOST") != "" {
+		pool, err := EnvRelayPool()
+		if err != nil {
+			results <- Result{FatalLevel, err, "Smarthost", nil}
+			return deliveryReport{total: len(e.Recipients), deferred: e.Recipients}
+		}
+		return e.deliverRelays(pool, message, results)
+	}
+	return e.deliverMTA(message, results)
+}
+
+// send generate the message once and deliver it in the background.
+// Recipients deferred by temporary errors are spooled to the Queue if it is set,
+// failed recipients are reported to the sender with the bounce function.
+func (e *Envelope) send(
+	deliver func(*Envelope, []byte, chan<- Result) deliveryReport,
+	bounce func(*Envelope) <-chan Result,
+) <-chan Result {
+	results := make(chan Result, len(e.Recipients))
+	message, err := e.signedMessage()
+	if err != nil {
+		results <- Result{FatalLevel, err, "Generate message", nil}
+		close(results)
+		return results
+	}
+	go func() {
+		report := deliver(e, message, results)
+		queued := 0
+		if len(report.deferred) > 0 && e.Queue != nil {
+			id, err := e.Queue.Enqueue(e, report.deferred, message)
+			if err != nil {
+				results <- Result{ErrorLevel, err, "Queue", Fields{
+					"sender":     e.Header.Get("From"),
+					"recipients": strings.Join(report.deferred, ","),
+				}}
+			} else {
+				results <- Result{InfoLevel, nil, "Queued for retry", Fields{
+					"sender":     e.Header.Get("From"),
+					"recipients": strings.Join(report.deferred, ","),
+					"queue_id":   id,
+				}}
+				queued = len(report.deferred)
+			}
+		}
+		if e.Bounce && len(report.failed) > 0 {
+			e.bounce(message, report.failed, bounce, results)
+		}
+		fields := Fields{
+			"sender":  e.Header.Get("From"),
+			"success": int32(report.success),
+			"total":   int32(report.total),
+		}
+		if queued > 0 {
+			fields["queued"] = int32(queued)
+		}
+		if failed := report.total - report.success - queued; failed == report.total {
+			results <- Result{ErrorLevel, errors.New("failed to deliver to all recipients"), "", fields}
+		} else if failed > 0 {
+			results <- Result{ErrorLevel, errors.New("failed to deliver to some recipients"), "", fields}
+		}
+		close(results)
+	}()
+	return results
+}
+
+// mailFrom return address for the MAIL FROM command,
+// it is empty for the null sender.
+func (e *Envelope) mailFrom() string {
+	if e.Sender == NullSender {
+		return ""
+	}
+	if e.Sender != "" {
+		return e.Sender
+	}
+	if from, err := mail.ParseAddress(e.Header.Get("From")); err == nil {
+		return from.Address
+	}
+	return e.Header.Get("From")
 }
 
 // GenerateMessage create body from mail.Message
@@ -124,6 +300,12 @@ func (e *Envelope) GenerateMessage() ([]byte, error) {
 		return nil, errors.New("empty header")
 	}
 
+	// Number of fields of every key in the original message
+	listed := make(map[string]int)
+	for _, field := range e.fields {
+		listed[field.key]++
+	}
+
 	buf := bytes.NewBuffer(nil)
 	keys := make([]string, 0, len(e.Header))
 	for key := range e.Header {
@@ -131,15 +313,50 @@ func (e *Envelope) GenerateMessage() ([]byte, error) {
 	}
 	sort.Strings(keys)
 
+	// New fields are written first, sorted by key
+	original := make(map[string][]string)
 	for _, key := range keys {
-		buf.WriteString(key + ": " + strings.Join(e.Header[key], ",") + "\r\n")
+		canonical := textproto.CanonicalMIMEHeaderKey(key)
+		values := e.Header[key]
+		n := listed[canonical]
+		if n > len(values) {
+			n = len(values)
+		}
+		// New values of a listed key are expected in front,
+		// as trace fields such as Received are prepended
+		added := values[:len(values)-n]
+		original[canonical] = values[len(values)-n:]
+		if n == 0 && addressHeaders[key] {
+			writeHeaderField(buf, key, strings.Join(added, ", "))
+			continue
+		}
+		for _, value := range added {
+			writeHeaderField(buf, key, value)
+		}
+	}
+	// Original fields keep their order, multiplicity and bytes,
+	// changed values are written with the original name
+	for _, field := range e.fields {
+		values := original[field.key]
+		if len(values) == 0 {
+			continue
+		}
+		if values[0] == field.value {
+			buf.WriteString(field.raw + "\r\n")
+		} else {
+			writeHeaderField(buf, field.raw[:strings.IndexByte(field.raw, ':')], values[0])
+		}
+		original[field.key] = values[1:]
 	}
 	buf.WriteString("\r\n")
 
-	_, err := buf.ReadFrom(e.Body)
+	body, err := ioutil.ReadAll(e.Body)
 	if err != nil {
 		return nil, err
 	}
+	// Bodies read from stdin have bare LF line endings,
+	// they are sent with CRLF and must be signed so
+	buf.Write(toCRLF(body))
 
 	if !bytes.HasSuffix(buf.Bytes(), []byte("\r\n")) {
 		buf.WriteString("\r\n")
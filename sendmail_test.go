@@ -108,7 +108,7 @@ func TestGenerateMessage(t *testing.T) {
 	if !strings.Contains(string(message), "From: sender@localhost\r\n") {
 		t.Error("Missing or incorrect From header")
 	}
-	if !strings.Contains(string(message), "Subject: =?UTF-8?B?c3ViamVjdA==\r\n") {
+	if !strings.Contains(string(message), "Subject: subject\r\n") {
 		t.Error("Missing or incorrect Subject header")
 	}
 	if !strings.Contains(string(message), "To: recipient@localhost\r\n") {
@@ -121,3 +121,54 @@ func TestGenerateMessage(t *testing.T) {
 		t.Errorf("Missing or incorrect body, got: %s", message)
 	}
 }
+
+func TestNewEnvelopeBcc(t *testing.T) {
+	body := []byte("From: sender@localhost\r\n" +
+		"To: to@example.com\r\n" +
+		"Cc: cc@example.com, to@example.com\r\n" +
+		"Bcc: bcc@example.com\r\n" +
+		"Subject: subject\r\n" +
+		"\r\n" +
+		"TEST\r\n")
+	tests := []struct {
+		config   sendmail.Config
+		expected []string
+	}{
+		{
+			config:   sendmail.Config{Body: body},
+			expected: []string{"to@example.com", "cc@example.com", "bcc@example.com"},
+		},
+		{
+			config:   sendmail.Config{Body: body, Recipients: []string{"other@example.com"}},
+			expected: []string{"other@example.com"},
+		},
+		{
+			config:   sendmail.Config{Body: body, Recipients: []string{"CC@example.com"}, ExtractRecipients: true},
+			expected: []string{"to@example.com", "bcc@example.com"},
+		},
+	}
+	for _, tt := range tests {
+		envelope, err := sendmail.NewEnvelope(&tt.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(envelope.Recipients, tt.expected) {
+			t.Error("Expected recipients", tt.expected, "got", envelope.Recipients)
+		}
+		message, err := envelope.GenerateMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(message, []byte("Bcc:")) || bytes.Contains(message, []byte("bcc@example.com")) {
+			t.Errorf("Expected Bcc removed, got: %s", message)
+		}
+	}
+
+	if _, err := sendmail.NewEnvelope(&sendmail.Config{
+		Body:              body,
+		Recipients:        []string{"to@example.com", "cc@example.com", "bcc@example.com"},
+		ExtractRecipients: true,
+	}); err == nil {
+		t.Error("Expected error for no recipients")
+	}
+}
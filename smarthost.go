@@ -1,49 +1,172 @@
 package sendmail
 
 import (
+	"errors"
+	"fmt"
 	"net"
-	"net/smtp"
+	"net/url"
 	"strings"
 )
 
+// Smart host URL schemes
+const (
+	// SchemeSMTP connects in plain text with STARTTLS by the envelope TLS policy
+	SchemeSMTP = "smtp"
+	// SchemeSMTPS connects with implicit TLS
+	SchemeSMTPS = "smtps"
+	// SchemeSMTPStartTLS requires STARTTLS with a valid certificate
+	SchemeSMTPStartTLS = "smtp+starttls"
+)
+
+var smarthostPorts = map[string]string{
+	SchemeSMTP:         "25",
+	SchemeSMTPS:        "465",
+	SchemeSMTPStartTLS: "587",
+}
+
+// parseSmarthost return server of the smart host given as host[:port]
+// or URL such as smtps://host:465, the port defaults by scheme.
+// The certificate of a smart host is always verified if STARTTLS is used,
+// as credentials must not be sent to an unverified server.
+func (e *Envelope) parseSmarthost(smarthost string) (smtpServer, error) {
+	server := smtpServer{addr: smarthost, policy: e.TLSPolicy}
+	if server.policy == TLSOpportunistic {
+		server.policy = TLSVerify
+	}
+	if strings.Contains(smarthost, "://") {
+		u, err := url.Parse(smarthost)
+		if err != nil {
+			return server, err
+		}
+		scheme := strings.ToLower(u.Scheme)
+		port, ok := smarthostPorts[scheme]
+		if !ok {
+			return server, fmt.Errorf("unsupported smart host scheme %s", u.Scheme)
+		}
+		if u.Hostname() == "" {
+			return server, fmt.Errorf("missing host in smart host URL %s", smarthost)
+		}
+		if u.Port() != "" {
+			port = u.Port()
+		}
+		server.addr = net.JoinHostPort(u.Hostname(), port)
+		switch scheme {
+		case SchemeSMTPS:
+			server.implicitTLS = true
+		case SchemeSMTPStartTLS:
+			server.policy = TLSRequire
+		}
+	} else if !strings.Contains(strings.TrimPrefix(smarthost, "["), ":") {
+		server.addr = net.JoinHostPort(smarthost, smarthostPorts[SchemeSMTP])
+	}
+	host, _, err := net.SplitHostPort(server.addr)
+	if err != nil {
+		return server, err
+	}
+	server.name = host
+	server.tlsConfig = e.tlsConfig(host)
+	return server, nil
+}
+
+// ValidateSmarthost check that smart host address can be used by SendSmarthost
+func ValidateSmarthost(smarthost string) error {
+	_, err := (&Envelope{}).parseSmarthost(smarthost)
+	return err
+}
+
 // SendSmarthost message delivery through an external mail server.
+// The smart host is host[:port] or URL with scheme smtp, smtps (implicit TLS)
+// or smtp+starttls (mandatory STARTTLS), for example smtps://host:465.
 func (e *Envelope) SendSmarthost(smarthost, login, password string) <-chan Result {
-	results := make(chan Result, len(e.Recipients))
-	host, _, err := net.SplitHostPort(smarthost)
-	if err != nil {
-		results <- Result{FatalLevel, err, "Smarthost", Fields{
-			"smarthost": smarthost,
-		}}
-	} else {
-		// Set up authentication information.
-		var auth smtp.Auth
-		if login != "" && password != "" {
-			auth = smtp.PlainAuth("", login, password, host)
-		}
-		generatedBody, err := e.GenerateMessage()
+	return e.SendSmarthostAuth(smarthost, Credentials{Login: login, Password: password})
+}
+
+// SendSmarthostAuth message delivery through an external mail server
+// authenticating with credentials, the AUTH mechanism is negotiated
+// unless forced by the credentials.
+func (e *Envelope) SendSmarthostAuth(smarthost string, credentials Credentials) <-chan Result {
+	return e.SendRelays(NewRelayPool(Relay{URL: smarthost, Credentials: credentials}))
+}
+
+// SendRelays message delivery through the smart hosts of pool. Recipients
+// are passed to the next relay on connection errors and 4xx replies,
+// the relay used is recorded in the smarthost field of results.
+func (e *Envelope) SendRelays(pool *RelayPool) <-chan Result {
+	if _, _, fields, err := e.relayServers(pool); err != nil {
+		results := make(chan Result, 1)
+		results <- Result{FatalLevel, err, "Smarthost", fields}
+		close(results)
+		return results
+	}
+	return e.send(func(e *Envelope, message []byte, results chan<- Result) deliveryReport {
+		return e.deliverRelays(pool, message, results)
+	}, func(dsn *Envelope) <-chan Result {
+		return dsn.SendRelays(pool)
+	})
+}
+
+// relayServers return relays of pool in the order of use and their servers,
+// on error the fields tell the invalid relay.
+func (e *Envelope) relayServers(pool *RelayPool) ([]Relay, []smtpServer, Fields, error) {
+	relays := pool.order()
+	if len(relays) == 0 {
+		return nil, nil, nil, errors.New("no smart hosts")
+	}
+	servers := make([]smtpServer, len(relays))
+	for i := range relays {
+		server, err := e.parseSmarthost(relays[i].URL)
 		if err != nil {
-			results <- Result{FatalLevel, err, "Generate message", nil}
-		} else {
-			fields := Fields{
-				"sender":     e.Header.Get("From"),
-				"smarthost":  smarthost,
-				"recipients": strings.Join(e.Recipients, ","),
+			return nil, nil, Fields{"smarthost": relays[i].URL}, err
+		}
+		server.credentials = &relays[i].Credentials
+		servers[i] = server
+	}
+	return relays, servers, nil, nil
+}
+
+// deliverRelays send generated message through the relays of pool,
+// recipients deferred by a relay are passed to the next one.
+func (e *Envelope) deliverRelays(pool *RelayPool, message []byte, results chan<- Result) deliveryReport {
+	report := deliveryReport{total: len(e.Recipients)}
+	relays, servers, fields, err := e.relayServers(pool)
+	if err != nil {
+		results <- Result{FatalLevel, err, "Smarthost", fields}
+		report.deferred = e.Recipients
+		return report
+	}
+	pending := e.Recipients
+	for i, server := range servers {
+		relay := relays[i].URL
+		// Connect to the server, authenticate, set the sender and recipients,
+		// and send the email.
+		statuses, tlsInfo := e.sendTo(server, pending, message)
+		var retry []string
+		delivered := 0
+		for _, recipient := range pending {
+			err := statuses[recipient]
+			results <- recipientResult(err, Fields{
+				"sender":    e.Header.Get("From"),
+				"smarthost": relay,
+				"recipient": recipient,
+			}, tlsInfo)
+			switch {
+			case err == nil:
+				delivered++
+			case isTemporary(err):
+				// Try the next relay
+				retry = append(retry, recipient)
+			default:
+				report.failed = append(report.failed, newFailedRecipient(recipient, server.name, err))
 			}
-			go func() {
-				// Connect to the server, authenticate, set the sender and recipient,
-				// and send the email all in one step.
-				err := smtp.SendMail(smarthost, auth,
-					e.Header.Get("From"),
-					e.Recipients,
-					generatedBody)
-				if err == nil {
-					results <- Result{InfoLevel, nil, "Send mail OK", fields}
-				} else {
-					results <- Result{ErrorLevel, err, "", fields}
-				}
-				close(results)
-			}()
-		}
-	}
-	return results
+		}
+		report.success += delivered
+		// The relay is failing if it accepted nothing and deferred something
+		pool.report(relay, delivered > 0 || len(retry) == 0)
+		pending = retry
+		if len(pending) == 0 {
+			break
+		}
+	}
+	report.deferred = pending
+	return report
 }
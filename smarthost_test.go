@@ -1,6 +1,7 @@
 package sendmail_test
 
 import (
+	"crypto/tls"
 	"testing"
 
 	"github.com/n0madic/sendmail"
@@ -9,6 +10,7 @@ import (
 
 func TestSendSmarthost(t *testing.T) {
 	go test.StartSMTP()
+	test.WaitSMTP()
 
 	for _, config := range testConfigs {
 		envelope, err := sendmail.NewEnvelope(&config.initial)
@@ -24,3 +26,56 @@ func TestSendSmarthost(t *testing.T) {
 		}
 	}
 }
+
+func TestSendSmarthostURL(t *testing.T) {
+	go test.StartSMTP()
+	go test.StartSMTPTLS()
+	go test.StartSMTPS()
+	test.WaitSMTP()
+	test.WaitPort(test.PortSMTPTLS)
+	test.WaitPort(test.PortSMTPS)
+
+	tests := []struct {
+		smarthost string
+		trusted   bool
+		delivered bool
+		tls       bool
+	}{
+		{"smtp://localhost:" + test.PortSMTP, false, true, false},
+		{"smtps://localhost:" + test.PortSMTPS, true, true, true},
+		{"smtps://localhost:" + test.PortSMTPS, false, false, false},
+		{"smtp+starttls://localhost:" + test.PortSMTPTLS, true, true, true},
+		{"smtp+starttls://localhost:" + test.PortSMTP, true, false, false},
+	}
+	for _, tt := range tests {
+		envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.trusted {
+			envelope.TLSConfig = &tls.Config{RootCAs: test.CertPool()}
+		}
+		delivered := false
+		for result := range envelope.SendSmarthost(tt.smarthost, "", "") {
+			if result.Level == sendmail.InfoLevel {
+				delivered = true
+				if result.Fields["tls"] != tt.tls {
+					t.Error(tt.smarthost, "expected tls", tt.tls, "got", result.Fields["tls"])
+				}
+			}
+		}
+		if delivered != tt.delivered {
+			t.Error(tt.smarthost, "expected delivered", tt.delivered, "got", delivered)
+		}
+	}
+
+	envelope, err := sendmail.NewEnvelope(&testConfigs[0].initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for result := range envelope.SendSmarthost("lmtp://localhost", "", "") {
+		if result.Level != sendmail.FatalLevel {
+			t.Error("Expected fatal result for unsupported scheme, got", result)
+		}
+	}
+}
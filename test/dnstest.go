@@ -0,0 +1,42 @@
+package test
+
+import (
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// StartDNS server on a random local UDP port which answers from zone,
+// keyed by the fully qualified name. The AD bit of answers is set if
+// authenticated. It returns the server address and a stop function.
+func StartDNS(zone map[string][]dns.RR, authenticated bool) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.AuthenticatedData = authenticated
+			q := r.Question[0]
+			records, ok := zone[dns.CanonicalName(q.Name)]
+			if !ok {
+				m.Rcode = dns.RcodeNameError
+			}
+			for _, rr := range records {
+				if rr.Header().Rrtype == q.Qtype {
+					m.Answer = append(m.Answer, rr)
+				}
+			}
+			w.WriteMsg(m)
+		}),
+	}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	<-started
+	return conn.LocalAddr().String(), func() { server.Shutdown() }
+}
@@ -1,12 +1,25 @@
 package test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
+	"math/big"
+	"net"
 	"net/mail"
 	"sync"
+	"time"
 
+	"github.com/emersion/go-sasl"
 	smtp "github.com/emersion/go-smtp"
 )
 
@@ -17,11 +30,23 @@ func (bkd *Backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
 	return &Session{}, nil
 }
 
-var once sync.Once
+var (
+	once     sync.Once
+	onceTLS  sync.Once
+	onceTLSI sync.Once
+	onceCert sync.Once
+	cert     tls.Certificate
+)
 
 // PortSMTP for tests
 const PortSMTP = "2525"
 
+// PortSMTPTLS for tests of STARTTLS with a self-signed certificate
+const PortSMTPTLS = "2526"
+
+// PortSMTPS for tests of implicit TLS with a self-signed certificate
+const PortSMTPS = "2527"
+
 // A Session is returned after successful login.
 type Session struct{}
 
@@ -30,9 +55,87 @@ func (s *Session) AuthPlain(username, password string) error {
 	return nil
 }
 
-// Mail check sender
+// Credentials accepted by the test servers, AUTH is only offered over TLS
+const (
+	AuthUser     = "user"
+	AuthPassword = "password"
+	AuthToken    = "token"
+)
+
+var errAuthFailed = &smtp.SMTPError{
+	Code:         535,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+	Message:      "Authentication credentials invalid",
+}
+
+// saslServer is a sasl.Server implemented by a function
+type saslServer func(response []byte) ([]byte, bool, error)
+
+func (f saslServer) Next(response []byte) ([]byte, bool, error) {
+	return f(response)
+}
+
+// AuthMechanisms supported by the test servers
+func (s *Session) AuthMechanisms() []string {
+	return []string{sasl.Plain, sasl.Login, "CRAM-MD5", "XOAUTH2"}
+}
+
+// Auth return server of the mechanism
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			if username != AuthUser || password != AuthPassword {
+				return errAuthFailed
+			}
+			return nil
+		}), nil
+	case sasl.Login:
+		var username string
+		step := 0
+		return saslServer(func(response []byte) ([]byte, bool, error) {
+			step++
+			switch step {
+			case 1:
+				return []byte("Username:"), false, nil
+			case 2:
+				username = string(response)
+				return []byte("Password:"), false, nil
+			}
+			if username != AuthUser || string(response) != AuthPassword {
+				return nil, true, errAuthFailed
+			}
+			return nil, true, nil
+		}), nil
+	case "CRAM-MD5":
+		challenge := fmt.Sprintf("<%d@localhost>", time.Now().UnixNano())
+		step := 0
+		return saslServer(func(response []byte) ([]byte, bool, error) {
+			step++
+			if step == 1 {
+				return []byte(challenge), false, nil
+			}
+			mac := hmac.New(md5.New, []byte(AuthPassword))
+			mac.Write([]byte(challenge))
+			if string(response) != AuthUser+" "+hex.EncodeToString(mac.Sum(nil)) {
+				return nil, true, errAuthFailed
+			}
+			return nil, true, nil
+		}), nil
+	case "XOAUTH2":
+		return saslServer(func(response []byte) ([]byte, bool, error) {
+			if string(response) != "user="+AuthUser+"\x01auth=Bearer "+AuthToken+"\x01\x01" {
+				return nil, true, errAuthFailed
+			}
+			return nil, true, nil
+		}), nil
+	}
+	return nil, smtp.ErrAuthUnknownMechanism
+}
+
+// Mail check sender, the null sender is allowed for notifications
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
-	if from != "sender@localhost" {
+	if from != "sender@localhost" && from != "" {
 		return fmt.Errorf("unknow sender %s", from)
 	}
 	return nil
@@ -40,8 +143,12 @@ func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 
 // Rcpt check recipients
 func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
-	if to != "recipient@localhost" {
-		return fmt.Errorf("unknow recipient %s", to)
+	if to != "recipient@localhost" && to != "sender@localhost" {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      fmt.Sprintf("unknow recipient %s", to),
+		}
 	}
 	return nil
 }
@@ -68,3 +175,85 @@ func StartSMTP() {
 		log.Fatalln(s.ListenAndServe())
 	})
 }
+
+// StartSMTPTLS server with STARTTLS support and a self-signed certificate
+func StartSMTPTLS() {
+	onceTLS.Do(func() {
+		s := smtp.NewServer(&Backend{})
+		s.Addr = "localhost:" + PortSMTPTLS
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{Certificate()}}
+		log.Fatalln(s.ListenAndServe())
+	})
+}
+
+// StartSMTPS server with implicit TLS and a self-signed certificate
+func StartSMTPS() {
+	onceTLSI.Do(func() {
+		s := smtp.NewServer(&Backend{})
+		s.Addr = "localhost:" + PortSMTPS
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{Certificate()}}
+		log.Fatalln(s.ListenAndServeTLS())
+	})
+}
+
+// CertPool trusting the certificate of the test servers
+func CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(Certificate().Leaf)
+	return pool
+}
+
+// Certificate of the servers started by StartSMTPTLS and StartSMTPS
+func Certificate() tls.Certificate {
+	onceCert.Do(func() {
+		var err error
+		cert, err = SelfSignedCertificate("localhost")
+		if err != nil {
+			log.Fatalln(err)
+		}
+	})
+	return cert
+}
+
+// SelfSignedCertificate generate certificate for host
+func SelfSignedCertificate(host string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// WaitSMTP blocks until the server started by StartSMTP accepts connections
+func WaitSMTP() {
+	WaitPort(PortSMTP)
+}
+
+// WaitPort blocks until a local server accepts connections on port
+func WaitPort(port string) {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", "localhost:"+port)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,103 @@
+package sendmail
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TLSPolicy for connections to mail servers
+type TLSPolicy int
+
+const (
+	// TLSOpportunistic use STARTTLS when advertised, without verification
+	// if the server certificate is invalid, and fall back to plain text
+	// if the TLS handshake fails. Smart hosts are verified as with TLSVerify.
+	TLSOpportunistic TLSPolicy = iota
+	// TLSNone never use STARTTLS.
+	TLSNone
+	// TLSVerify use STARTTLS when advertised, the certificate must be valid.
+	TLSVerify
+	// TLSRequire refuse delivery without STARTTLS and a valid certificate.
+	TLSRequire
+)
+
+var tlsPolicyNames = map[TLSPolicy]string{
+	TLSOpportunistic: "opportunistic",
+	TLSNone:          "none",
+	TLSVerify:        "verify",
+	TLSRequire:       "require",
+}
+
+func (p TLSPolicy) String() string {
+	if name, ok := tlsPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("TLSPolicy(%d)", int(p))
+}
+
+// ParseTLSPolicy return policy by name:
+// none, opportunistic, verify or require.
+func ParseTLSPolicy(name string) (TLSPolicy, error) {
+	for policy, policyName := range tlsPolicyNames {
+		if strings.EqualFold(name, policyName) {
+			return policy, nil
+		}
+	}
+	return TLSOpportunistic, fmt.Errorf("unknown TLS policy %s", name)
+}
+
+// errNoSTARTTLS is returned when TLS is required but not offered by the server
+var errNoSTARTTLS = errors.New("server doesn't support STARTTLS")
+
+// isCertificateError reports whether err is caused by server certificate verification.
+func isCertificateError(err error) bool {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+	)
+	return errors.As(err, &unknownAuthority) ||
+		errors.As(err, &hostname) ||
+		errors.As(err, &invalid)
+}
+
+// tlsFields describes negotiated TLS connection for results
+func tlsFields(state *tls.ConnectionState, verified bool) Fields {
+	if state == nil {
+		return Fields{"tls": false}
+	}
+	return Fields{
+		"tls":          true,
+		"tls_version":  tlsVersionName(state.Version),
+		"tls_cipher":   tls.CipherSuiteName(state.CipherSuite),
+		"tls_verified": verified,
+	}
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+// tlsConfig return copy of the envelope TLS configuration for server name,
+// nil if there is no configuration.
+func (e *Envelope) tlsConfig(name string) *tls.Config {
+	if e.TLSConfig == nil {
+		return nil
+	}
+	config := e.TLSConfig.Clone()
+	config.ServerName = name
+	return config
+}
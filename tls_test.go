@@ -0,0 +1,92 @@
+package sendmail_test
+
+import (
+	"testing"
+
+	"github.com/n0madic/sendmail"
+	"github.com/n0madic/sendmail/test"
+)
+
+func TestParseTLSPolicy(t *testing.T) {
+	for _, policy := range []sendmail.TLSPolicy{
+		sendmail.TLSNone,
+		sendmail.TLSOpportunistic,
+		sendmail.TLSVerify,
+		sendmail.TLSRequire,
+	} {
+		parsed, err := sendmail.ParseTLSPolicy(policy.String())
+		if err != nil {
+			t.Error(err)
+		}
+		if parsed != policy {
+			t.Error("Expected", policy, "got", parsed)
+		}
+	}
+	if _, err := sendmail.ParseTLSPolicy("unknown"); err == nil {
+		t.Error("Expected error for unknown policy")
+	}
+}
+
+func TestTLSPolicy(t *testing.T) {
+	go test.StartSMTP()
+	go test.StartSMTPTLS()
+	test.WaitSMTP()
+	test.WaitPort(test.PortSMTPTLS)
+
+	tests := []struct {
+		policy    sendmail.TLSPolicy
+		port      string
+		delivered bool
+		tls       bool
+	}{
+		{sendmail.TLSNone, test.PortSMTPTLS, true, false},
+		{sendmail.TLSOpportunistic, test.PortSMTPTLS, true, true},
+		{sendmail.TLSOpportunistic, test.PortSMTP, true, false},
+		{sendmail.TLSVerify, test.PortSMTPTLS, false, false},
+		{sendmail.TLSVerify, test.PortSMTP, true, false},
+		{sendmail.TLSRequire, test.PortSMTP, false, false},
+	}
+	for _, tt := range tests {
+		config := testConfigs[0].initial
+		config.PortSMTP = tt.port
+		config.TLSPolicy = tt.policy
+		envelope, err := sendmail.NewEnvelope(&config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delivered := false
+		for result := range envelope.SendLikeMTA() {
+			if result.Level == sendmail.InfoLevel {
+				delivered = true
+				if result.Fields["tls"] != tt.tls {
+					t.Error(tt.policy, "expected tls", tt.tls, "got", result.Fields["tls"])
+				}
+				if tt.policy == sendmail.TLSOpportunistic && tt.port == test.PortSMTPTLS {
+					if result.Fields["tls_verified"] != false || result.Fields["tls_error"] == nil {
+						t.Error("Expected unverified TLS with tls_error for self-signed certificate, got", result.Fields)
+					}
+				}
+			}
+		}
+		if delivered != tt.delivered {
+			t.Error(tt.policy, "on port", tt.port, "expected delivered", tt.delivered, "got", delivered)
+		}
+	}
+}
+
+func TestSmarthostTLSVerify(t *testing.T) {
+	go test.StartSMTPTLS()
+	test.WaitPort(test.PortSMTPTLS)
+
+	config := testConfigs[0].initial
+	envelope, err := sendmail.NewEnvelope(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.TLSPolicy = sendmail.TLSOpportunistic
+	for result := range envelope.SendSmarthost("localhost:"+test.PortSMTPTLS, "user", "secret") {
+		if result.Level == sendmail.InfoLevel {
+			t.Error("Expected no delivery to smart host with invalid certificate, got", result.Fields)
+		}
+	}
+}
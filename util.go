@@ -9,6 +9,7 @@ import (
 	"log"
 	"net/mail"
 	"strings"
+	"time"
 )
 
 func generateMessageID(domain string) string {
@@ -53,3 +54,21 @@ func GetDomainFromAddress(address string) string {
 	}
 	return ""
 }
+
+// toCRLF replace bare LF line endings with CRLF
+func toCRLF(data []byte) []byte {
+	if bytes.Count(data, []byte("\n")) == bytes.Count(data, []byte("\r\n")) {
+		return data
+	}
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
+
+func generateQueueID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return fmt.Sprintf("%X%X", time.Now().Unix(), b)
+}